@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/Supercaly/tinlang/pkg/tin"
@@ -16,28 +17,125 @@ func usage(stream io.Writer, program string) {
 	fmt.Fprintf(stream, "Usage %s [OPTIONS] <input.tin>\n", program)
 	fmt.Fprintf(stream, "OPTIONS:\n")
 	fmt.Fprintf(stream, "  -h	Print this help message\n")
+	fmt.Fprintf(stream, "  -O0	Disable optimizations (default)\n")
+	fmt.Fprintf(stream, "  -O1	Enable optimizations\n")
+	fmt.Fprintf(stream, "  -v	Report the unused definitions removed with -O1\n")
+	fmt.Fprintf(stream, "  -release	Strip runtime asserts\n")
+	fmt.Fprintf(stream, "  -sim	Simulate the program instead of compiling it\n")
+	fmt.Fprintf(stream, "  -stack-check=off|warn|runtime	Report values left on the stack at the end (default warn)\n")
+	fmt.Fprintf(stream, "  -ret-stack=SIZE	Size in bytes of the return stack (default 1024)\n")
+	fmt.Fprintf(stream, "  -D NAME[=VALUE]	Define the const NAME with VALUE (default 1)\n")
+}
+
+// parseDefine parses a define in the form NAME or NAME=VALUE.
+func parseDefine(define string) (name string, value int, err error) {
+	eq := strings.Index(define, "=")
+	if eq == 0 || define == "" {
+		return "", 0, fmt.Errorf("missing name in define '%s'", define)
+	}
+	if eq < 0 {
+		return define, 1, nil
+	}
+	value, err = strconv.Atoi(define[eq+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid value in define '%s'", define)
+	}
+	return define[:eq], value, nil
 }
 
 func main() {
 	program := os.Args[0]
 	os.Args = os.Args[1:]
 
-	if len(os.Args) <= 0 {
-		usage(os.Stderr, program)
-		log.Fatal("ERROR: missing input file name")
+	var inputFilePath string
+	optimizationLevel := 0
+	stripAsserts := false
+	simulate := false
+	verbose := false
+	stackCheck := tin.StackCheckWarn
+	retStackSize := 0
+	defines := make(map[string]int)
+	for len(os.Args) > 0 {
+		arg := os.Args[0]
+		os.Args = os.Args[1:]
+
+		switch arg {
+		case "-h":
+			usage(os.Stdout, program)
+			os.Exit(0)
+		case "-O0":
+			optimizationLevel = 0
+		case "-O1":
+			optimizationLevel = 1
+		case "-release":
+			stripAsserts = true
+		case "-sim":
+			simulate = true
+		case "-v":
+			verbose = true
+		case "-stack-check=off":
+			stackCheck = tin.StackCheckOff
+		case "-stack-check=warn":
+			stackCheck = tin.StackCheckWarn
+		case "-stack-check=runtime":
+			stackCheck = tin.StackCheckRuntime
+		case "-D":
+			if len(os.Args) == 0 {
+				usage(os.Stderr, program)
+				log.Fatal("ERROR: missing define after -D")
+			}
+			arg = "-D" + os.Args[0]
+			os.Args = os.Args[1:]
+			fallthrough
+		default:
+			if strings.HasPrefix(arg, "-D") {
+				name, value, err := parseDefine(arg[2:])
+				if err != nil {
+					log.Fatalf("ERROR: %s", err)
+				}
+				defines[name] = value
+				continue
+			}
+			if strings.HasPrefix(arg, "-ret-stack=") {
+				size, err := strconv.Atoi(strings.TrimPrefix(arg, "-ret-stack="))
+				if err != nil || size <= 0 || size%8 != 0 {
+					log.Fatalf("ERROR: the return stack size must be a positive multiple of 8")
+				}
+				retStackSize = size
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
+				usage(os.Stderr, program)
+				log.Fatalf("ERROR: unknown option '%s'", arg)
+			}
+			inputFilePath = arg
+		}
 	}
 
-	if os.Args[0] == "-h" {
-		usage(os.Stdout, program)
-		os.Exit(0)
+	if inputFilePath == "" {
+		usage(os.Stderr, program)
+		log.Fatal("ERROR: missing input file name")
 	}
 
-	inputFilePath := os.Args[0]
 	outputFilePathNoExt := strings.TrimSuffix(inputFilePath, filepath.Ext(inputFilePath))
 
 	option := tin.CompilerOption{
-		InputPath:  inputFilePath,
-		OutputPath: outputFilePathNoExt + ".asm",
+		InputPath:         inputFilePath,
+		OutputPath:        outputFilePathNoExt + ".asm",
+		OptimizationLevel: optimizationLevel,
+		Defines:           defines,
+		StripAsserts:      stripAsserts,
+		StackCheck:        stackCheck,
+		ReturnStackSize:   retStackSize,
+		Verbose:           verbose,
+	}
+
+	if simulate {
+		exitCode, err := tin.SimulateFile(option)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(exitCode)
 	}
 
 	if err := tin.CompileFile(option); err != nil {
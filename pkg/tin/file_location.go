@@ -3,11 +3,21 @@ package tin
 import "fmt"
 
 type fileLocation struct {
-	fileName string
-	col      int
-	row      int
+	fileName  string
+	col       int
+	row       int
+	expansion *macroExpansion
 }
 
 func (fl fileLocation) String() string {
-	return fmt.Sprintf("%s:%d:%d", fl.fileName, fl.row+1, fl.col+1)
+	out := fmt.Sprintf("%s:%d:%d", fl.fileName, fl.row+1, fl.col+1)
+	if fl.expansion != nil {
+		site := fl.expansion.site
+		if fl.expansion.inlined {
+			out += fmt.Sprintf(" (in function '%s' inlined at %s:%d:%d)", fl.expansion.name, site.fileName, site.row+1, site.col+1)
+		} else {
+			out += fmt.Sprintf(" (in macro '%s' expanded at %s:%d:%d)", fl.expansion.name, site.fileName, site.row+1, site.col+1)
+		}
+	}
+	return out
 }
@@ -0,0 +1,235 @@
+package tin
+
+import "fmt"
+
+const (
+	// functions with a body up to this number of instructions are inlined
+	// automatically when optimizing
+	autoInlineThreshold int = 8
+)
+
+// relocation tells how the address of an instruction should be updated
+// when moving it in a new program.
+type relocation int
+
+const (
+	// the address refers to the original program
+	relocationGlobal relocation = iota
+	// the address refers to the range that is being expanded
+	relocationLocal
+	// the address is already final
+	relocationDone
+)
+
+type inliner struct {
+	program    Program
+	inlinable  map[int]bool
+	bodies     map[int][]Instruction
+	relocs     map[int][]relocation
+	inProgress map[int]bool
+}
+
+// inlineFunctions replaces every call to an inline function with the body
+// of the function. When autoInline is true small functions that don't
+// call other functions are inlined too.
+func inlineFunctions(program Program, autoInline bool) Program {
+	in := inliner{
+		program:    program,
+		inlinable:  make(map[int]bool),
+		bodies:     make(map[int][]Instruction),
+		relocs:     make(map[int][]relocation),
+		inProgress: make(map[int]bool),
+	}
+
+	for addr, inst := range program {
+		if inst.Kind != InstKindFunDef {
+			continue
+		}
+		if inst.Inline {
+			if !in.canInline(addr) {
+				panic(fmt.Sprintf("%s: function '%s' can't be inlined because it contains another function", inst.token.location, inst.ValueString))
+			}
+			in.inlinable[addr] = true
+		} else if autoInline && in.canInline(addr) && in.isSmallLeaf(addr) {
+			in.inlinable[addr] = true
+		}
+	}
+	if len(in.inlinable) == 0 {
+		return program
+	}
+
+	out, relocs, pos := in.expandRange(0, len(program), false)
+	for i := range out {
+		if relocs[i] == relocationGlobal {
+			relocateInstruction(&out[i], pos)
+		}
+	}
+	return out
+}
+
+// bodyRange returns the range of addresses of the body of the function
+// defined at addr, the end is the address of its final return.
+func (in *inliner) bodyRange(addr int) (start int, end int) {
+	return addr + 1, in.program[addr-1].JmpAddress - 1
+}
+
+func (in *inliner) canInline(addr int) bool {
+	start, end := in.bodyRange(addr)
+	for _, inst := range in.program[start:end] {
+		if inst.Kind == InstKindFunSkip {
+			return false
+		}
+	}
+	return true
+}
+
+func (in *inliner) isSmallLeaf(addr int) bool {
+	start, end := in.bodyRange(addr)
+	if end-start > autoInlineThreshold {
+		return false
+	}
+	for _, inst := range in.program[start:end] {
+		if inst.Kind == InstKindFunCall || (inst.Kind == InstKindIntrinsic && inst.ValueIntrinsic == IntrinsicCall) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandRange copies the instructions of the program between start and
+// end replacing the calls to inlinable functions with their body. When
+// isBody is true the range is the body of a function and its returns
+// become jumps to the end of the range.
+// It returns the new instructions, how their addresses must be relocated
+// and the new position of each address of the range.
+func (in *inliner) expandRange(start int, end int, isBody bool) (out []Instruction, relocs []relocation, pos map[int]int) {
+	pos = make(map[int]int)
+	for addr := start; addr < end; addr++ {
+		pos[addr] = len(out)
+		inst := in.program[addr]
+
+		if inst.Kind == InstKindFunCall && in.inlinable[inst.JmpAddress] {
+			body, bodyRelocs := in.expandFunction(inst.JmpAddress, inst.token)
+			// inlined instructions are located at the call site
+			expansion := &macroExpansion{
+				name:    in.program[inst.JmpAddress].ValueString,
+				site:    inst.token.location,
+				level:   1,
+				inlined: true,
+			}
+			base := len(out)
+			for i, bodyInst := range body {
+				if bodyRelocs[i] == relocationDone {
+					shiftInstruction(&bodyInst, base)
+				}
+				bodyInst.token.location.expansion = expansion
+				out = append(out, bodyInst)
+				relocs = append(relocs, bodyRelocs[i])
+			}
+			continue
+		}
+
+		if isBody && inst.Kind == InstKindFunRet {
+			inst = Instruction{
+				Kind:       InstKindJump,
+				token:      inst.token,
+				JmpAddress: end,
+			}
+		}
+		reloc := relocationGlobal
+		if hasJmpAddress(inst.Kind) && inst.JmpAddress >= start && inst.JmpAddress <= end {
+			reloc = relocationLocal
+		}
+		out = append(out, inst)
+		relocs = append(relocs, reloc)
+	}
+	pos[end] = len(out)
+
+	for i := range out {
+		if relocs[i] == relocationLocal {
+			relocateInstruction(&out[i], pos)
+			relocs[i] = relocationDone
+		}
+	}
+	return out, relocs, pos
+}
+
+// expandFunction returns the body of the function defined at addr with
+// all the inlinable calls already expanded.
+func (in *inliner) expandFunction(addr int, site token) ([]Instruction, []relocation) {
+	if body, ok := in.bodies[addr]; ok {
+		return body, in.relocs[addr]
+	}
+	if in.inProgress[addr] {
+		panic(fmt.Sprintf("%s: cannot inline the recursive function '%s'", site.location, in.program[addr].ValueString))
+	}
+
+	in.inProgress[addr] = true
+	start, end := in.bodyRange(addr)
+	body, relocs, _ := in.expandRange(start, end, true)
+	delete(in.inProgress, addr)
+
+	in.bodies[addr] = body
+	in.relocs[addr] = relocs
+	return body, relocs
+}
+
+// hasJmpAddress returns true if JmpAddress is meaningful for the given
+// kind of instruction.
+func hasJmpAddress(kind InstKind) bool {
+	switch kind {
+	case InstKindTestCondition, InstKindElse, InstKindElif, InstKindMatch, InstKindCase,
+		InstKindEnd, InstKindJump, InstKindBreak, InstKindContinue,
+		InstKindForTest, InstKindForNext,
+		InstKindFunSkip, InstKindFunCall, InstKindFunAddr, InstKindFunCast:
+		return true
+	}
+	return false
+}
+
+// jumpTargets returns the addresses of the instructions that can be
+// reached by a jump or a call.
+func jumpTargets(program Program) map[int]bool {
+	targets := make(map[int]bool)
+	for _, inst := range program {
+		if !hasJmpAddress(inst.Kind) {
+			continue
+		}
+		targets[inst.JmpAddress] = true
+		for _, c := range inst.ValueCases {
+			targets[c.Address] = true
+		}
+	}
+	return targets
+}
+
+// relocateInstruction updates the addresses of inst using the new
+// positions in pos.
+func relocateInstruction(inst *Instruction, pos map[int]int) {
+	if !hasJmpAddress(inst.Kind) {
+		return
+	}
+	inst.JmpAddress = pos[inst.JmpAddress]
+	if len(inst.ValueCases) > 0 {
+		cases := make([]MatchCase, len(inst.ValueCases))
+		for i, c := range inst.ValueCases {
+			cases[i] = MatchCase{Value: c.Value, Address: pos[c.Address]}
+		}
+		inst.ValueCases = cases
+	}
+}
+
+// shiftInstruction moves the addresses of inst by offset.
+func shiftInstruction(inst *Instruction, offset int) {
+	if !hasJmpAddress(inst.Kind) {
+		return
+	}
+	inst.JmpAddress += offset
+	if len(inst.ValueCases) > 0 {
+		cases := make([]MatchCase, len(inst.ValueCases))
+		for i, c := range inst.ValueCases {
+			cases[i] = MatchCase{Value: c.Value, Address: c.Address + offset}
+		}
+		inst.ValueCases = cases
+	}
+}
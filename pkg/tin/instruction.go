@@ -11,15 +11,33 @@ const (
 
 	InstKindTestCondition
 	InstKindElse
+	InstKindElif
+	InstKindMatch
+	InstKindCase
 	InstKindWhile
 	InstKindEnd
+	InstKindJump
+	InstKindBreak
+	InstKindContinue
+
+	InstKindForStart
+	InstKindForTest
+	InstKindForNext
+	InstKindForEnd
+	InstKindForIndex
 
 	InstKindFunSkip
 	InstKindFunDef
 	InstKindFunRet
 	InstKindFunCall
+	InstKindFunAddr
+	InstKindFunCast
 
 	InstKindMemPush
+	InstKindDataPush
+
+	InstKindAssert
+	InstKindDrop
 )
 
 type Instruction struct {
@@ -29,7 +47,27 @@ type Instruction struct {
 	ValueString    string
 	ValueIntrinsic Intrinsic
 	ValueMemory    int
+	ValueData      DataBlock
+	ValueCases     []MatchCase
 	JmpAddress     int
+	Inline         bool
+	// the call is the last instruction executed by its function
+	TailCall bool
+}
+
+// MatchCase is a case of a match, when the matched value is Value the
+// execution continues from Address.
+type MatchCase struct {
+	Value   int
+	Address int
+}
+
+// DataBlock is a block of initialized data placed in the data section
+// of the generated program.
+type DataBlock struct {
+	Name     string
+	Bytes    []byte
+	ReadOnly bool
 }
 
 type Intrinsic int
@@ -47,6 +85,16 @@ const (
 	IntrinsicDup
 
 	IntrinsicPrint
+	IntrinsicPrintNumber
+	IntrinsicBufferedWrite
+	IntrinsicFlush
+
+	IntrinsicAlloc
+	IntrinsicFree
+	IntrinsicRealloc
+
+	IntrinsicCall
+	IntrinsicExit
 
 	IntrinsicSyscall0
 	IntrinsicSyscall1
@@ -74,6 +122,14 @@ var intrinsicMap = map[string]Intrinsic{
 	"!=":       IntrinsicNotEqual,
 	"dup":      IntrinsicDup,
 	"print":    IntrinsicPrint,
+	"printn":   IntrinsicPrintNumber,
+	"bwrite":   IntrinsicBufferedWrite,
+	"flush":    IntrinsicFlush,
+	"alloc":    IntrinsicAlloc,
+	"free":     IntrinsicFree,
+	"realloc":  IntrinsicRealloc,
+	"call":     IntrinsicCall,
+	"exit":     IntrinsicExit,
 	"syscall0": IntrinsicSyscall0,
 	"syscall1": IntrinsicSyscall1,
 	"syscall2": IntrinsicSyscall2,
@@ -95,7 +151,12 @@ func (i Instruction) String() (out string) {
 	// TODO: Better print the instruction
 	switch i.Kind {
 	case InstKindPushInt:
-		out += fmt.Sprint(i.ValueInt)
+		if i.token.kind == tokenKindWord {
+			// the value comes from a named constant
+			out += fmt.Sprintf("%s(%d)", i.token.value, i.ValueInt)
+		} else {
+			out += fmt.Sprint(i.ValueInt)
+		}
 	case InstKindPushString:
 		out += i.ValueString
 	case InstKindIntrinsic:
@@ -104,18 +165,56 @@ func (i Instruction) String() (out string) {
 		out += fmt.Sprintf("(test %d)", i.JmpAddress)
 	case InstKindElse:
 		out += fmt.Sprintf("(else %d)", i.JmpAddress)
+	case InstKindElif:
+		out += fmt.Sprintf("(elif %d)", i.JmpAddress)
+	case InstKindMatch:
+		out += "(match"
+		for _, c := range i.ValueCases {
+			out += fmt.Sprintf(" %d:%d", c.Value, c.Address)
+		}
+		out += fmt.Sprintf(" else:%d)", i.JmpAddress)
+	case InstKindCase:
+		out += fmt.Sprintf("(case %d)", i.JmpAddress)
 	case InstKindEnd:
 		out += fmt.Sprintf("(end %d)", i.JmpAddress)
 	case InstKindWhile:
 		out += "while"
+	case InstKindJump:
+		out += fmt.Sprintf("(jmp %d)", i.JmpAddress)
+	case InstKindBreak:
+		out += fmt.Sprintf("(break %d)", i.JmpAddress)
+	case InstKindContinue:
+		out += fmt.Sprintf("(continue %d)", i.JmpAddress)
+	case InstKindForStart:
+		out += fmt.Sprintf("(for step %d)", i.ValueInt)
+	case InstKindForTest:
+		out += fmt.Sprintf("(fortest %d)", i.JmpAddress)
+	case InstKindForNext:
+		out += fmt.Sprintf("(fornext %d)", i.JmpAddress)
+	case InstKindForEnd:
+		out += "forend"
+	case InstKindForIndex:
+		out += "i"
 	case InstKindFunSkip:
 		out += fmt.Sprintf("(fskip %d)", i.JmpAddress)
 	case InstKindFunDef:
-		out += "fdef"
+		out += fmt.Sprintf("(fdef %s)", i.ValueString)
 	case InstKindFunRet:
 		out += "fret"
 	case InstKindFunCall:
 		out += fmt.Sprintf("(fcall %d)", i.JmpAddress)
+	case InstKindFunAddr:
+		out += fmt.Sprintf("(faddr %d)", i.JmpAddress)
+	case InstKindFunCast:
+		out += fmt.Sprintf("(fcast %d)", i.JmpAddress)
+	case InstKindMemPush:
+		out += fmt.Sprintf("(mem %d)", i.ValueMemory)
+	case InstKindDataPush:
+		out += fmt.Sprintf("(data %s)", i.ValueData.Name)
+	case InstKindAssert:
+		out += "assert"
+	case InstKindDrop:
+		out += fmt.Sprintf("(drop %d)", i.ValueInt)
 	}
 	return out
 }
@@ -127,13 +226,29 @@ func (ik InstKind) String() string {
 		"InstKindIntrinsic",
 		"InstKindTestCondition",
 		"InstKindElse",
+		"InstKindElif",
+		"InstKindMatch",
+		"InstKindCase",
 		"InstKindWhile",
 		"InstKindEnd",
+		"InstKindJump",
+		"InstKindBreak",
+		"InstKindContinue",
+		"InstKindForStart",
+		"InstKindForTest",
+		"InstKindForNext",
+		"InstKindForEnd",
+		"InstKindForIndex",
 		"InstKindFunSkip",
 		"InstKindFunDef",
 		"InstKindFunRet",
 		"InstKindFunCall",
+		"InstKindFunAddr",
+		"InstKindFunCast",
 		"InstKindMemPush",
+		"InstKindDataPush",
+		"InstKindAssert",
+		"InstKindDrop",
 	}[ik]
 }
 
@@ -148,6 +263,14 @@ func (i Intrinsic) String() string {
 		"!=",
 		"dup",
 		"print",
+		"printn",
+		"bwrite",
+		"flush",
+		"alloc",
+		"free",
+		"realloc",
+		"call",
+		"exit",
 		"syscall0",
 		"syscall1",
 		"syscall2",
@@ -0,0 +1,162 @@
+package tin
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	maxMacroExpansionLevel int = 100
+)
+
+type macro struct {
+	name     string
+	params   []string
+	body     []token
+	location fileLocation
+	// names defined inside the body, they are renamed at every expansion
+	// so they don't leak outside of the macro
+	localNames map[string]bool
+}
+
+// macroExpansion records where a macro was expanded (or a function was
+// inlined), tokens coming from its body point to it from their location.
+type macroExpansion struct {
+	name    string
+	site    fileLocation
+	level   int
+	inlined bool
+}
+
+// keywords that are closed by an 'end'
+var blockKeywords = map[string]bool{
+	"if":     true,
+	"while":  true,
+	"for":    true,
+	"match":  true,
+	"def":    true,
+	"memory": true,
+	"const":  true,
+	"struct": true,
+	"enum":   true,
+	"data":   true,
+	"rodata": true,
+	"macro":  true,
+
+	"static_assert": true,
+}
+
+// keywords that are followed by the name of what they define
+var definitionKeywords = map[string]bool{
+	"def":    true,
+	"memory": true,
+	"const":  true,
+	"struct": true,
+	"enum":   true,
+	"data":   true,
+	"rodata": true,
+	"macro":  true,
+}
+
+// parseMacroDefinition parses a macro in the form 'name body end' or
+// 'name(param1,param2) body end' where tokens starts at the name.
+func parseMacroDefinition(tokens *[]token, location fileLocation) (m macro) {
+	if len(*tokens) == 0 || (*tokens)[0].kind != tokenKindWord {
+		panic(fmt.Sprintf("%s: 'macro' used without a name", location))
+	}
+	m.location = location
+	m.name, m.params = splitMacroName((*tokens)[0])
+	*tokens = (*tokens)[1:]
+
+	level := 0
+	for {
+		if len(*tokens) == 0 {
+			panic(fmt.Sprintf("%s: macro '%s' used whitout an end", location, m.name))
+		}
+		token := (*tokens)[0]
+		*tokens = (*tokens)[1:]
+
+		if token.kind == tokenKindKeyword {
+			if token.value == "end" {
+				if level == 0 {
+					break
+				}
+				level--
+			} else if blockKeywords[token.value] {
+				level++
+			}
+		}
+		m.body = append(m.body, token)
+	}
+
+	m.localNames = make(map[string]bool)
+	for i, token := range m.body {
+		if token.kind == tokenKindKeyword && definitionKeywords[token.value] && i+1 < len(m.body) {
+			name, _ := splitMacroName(m.body[i+1])
+			m.localNames[name] = true
+		}
+	}
+	return m
+}
+
+// splitMacroName splits a word like 'name(a,b)' in its name and parameters.
+func splitMacroName(t token) (name string, params []string) {
+	open := strings.Index(t.value, "(")
+	if open < 0 {
+		return t.value, nil
+	}
+	if !strings.HasSuffix(t.value, ")") {
+		panic(fmt.Sprintf("%s: malformed macro parameters in '%s'", t.location, t.value))
+	}
+	name = t.value[:open]
+	if inner := t.value[open+1 : len(t.value)-1]; inner != "" {
+		params = strings.Split(inner, ",")
+	}
+	return name, params
+}
+
+// expandMacro returns the tokens of the expansion of m at the site token
+// followed by the remaining tokens. The arguments of the macro are the
+// tokens that follow the site.
+func (p *parser) expandMacro(m macro, site token, tokens []token) []token {
+	level := 1
+	if site.location.expansion != nil {
+		level = site.location.expansion.level + 1
+	}
+	if level > maxMacroExpansionLevel {
+		panic(fmt.Sprintf("%s: max macro expansion level reached expanding '%s' defined at %s", site.location, m.name, m.location))
+	}
+	if len(tokens) < len(m.params) {
+		panic(fmt.Sprintf("%s: macro '%s' defined at %s expects %d arguments", site.location, m.name, m.location, len(m.params)))
+	}
+	args := make(map[string]token)
+	for i, param := range m.params {
+		args[param] = tokens[i]
+	}
+	tokens = tokens[len(m.params):]
+
+	p.macroExpansions++
+	expansion := &macroExpansion{
+		name:  m.name,
+		site:  site.location,
+		level: level,
+	}
+	out := make([]token, 0, len(m.body)+len(tokens))
+	for _, t := range m.body {
+		if arg, ok := args[t.value]; ok && t.kind == tokenKindWord {
+			// arguments keep their location but count as part of the
+			// expansion, so a macro can't recurse through them forever
+			if arg.location.expansion == nil || arg.location.expansion.level < level {
+				arg.location.expansion = expansion
+			}
+			out = append(out, arg)
+			continue
+		}
+		if t.kind == tokenKindWord && m.localNames[t.value] {
+			t.value = fmt.Sprintf("%s@%d", t.value, p.macroExpansions)
+		}
+		t.location.expansion = expansion
+		out = append(out, t)
+	}
+	return append(out, tokens...)
+}
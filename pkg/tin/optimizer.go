@@ -0,0 +1,339 @@
+package tin
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// optimizeProgram runs the optimization passes enabled with -O1 until
+// the program stops shrinking, removing a branch can give new constants
+// to fold.
+func optimizeProgram(program Program) Program {
+	for {
+		size := len(program)
+		program = foldConstants(program)
+		program = removeDeadCode(program)
+		if len(program) >= size {
+			return program
+		}
+	}
+}
+
+// foldConstants evaluates at compile time the intrinsics, the drops and
+// the branches that only use values pushed by the previous instructions.
+// The values are tracked only in straight line code, a jump target
+// always starts with no known values.
+func foldConstants(program Program) Program {
+	targets := jumpTargets(program)
+	out := Program{}
+	pos := make(map[int]int)
+	// number of instructions at the end of out that push a known value
+	known := 0
+
+	for addr, inst := range program {
+		pos[addr] = len(out)
+		if targets[addr] {
+			known = 0
+		}
+
+		switch inst.Kind {
+		case InstKindPushInt:
+			out = append(out, inst)
+			known++
+			continue
+		case InstKindIntrinsic:
+			if results, args, ok := evalIntrinsic(inst.ValueIntrinsic, out[len(out)-known:]); ok {
+				out = out[:len(out)-args]
+				for _, value := range results {
+					out = append(out, Instruction{Kind: InstKindPushInt, token: inst.token, ValueInt: value})
+				}
+				known += len(results) - args
+				continue
+			}
+		case InstKindDrop:
+			if known >= inst.ValueInt {
+				out = out[:len(out)-inst.ValueInt]
+				known -= inst.ValueInt
+				continue
+			}
+		case InstKindTestCondition:
+			if known >= 1 {
+				cond := out[len(out)-1].ValueInt
+				out = out[:len(out)-1]
+				known--
+				if cond == 0 {
+					out = append(out, Instruction{Kind: InstKindJump, token: inst.token, JmpAddress: inst.JmpAddress})
+					known = 0
+				}
+				continue
+			}
+		case InstKindMatch:
+			if known >= 1 {
+				value := out[len(out)-1].ValueInt
+				out = out[:len(out)-1]
+				jump := Instruction{Kind: InstKindJump, token: inst.token, JmpAddress: inst.JmpAddress}
+				for _, c := range inst.ValueCases {
+					if c.Value == value {
+						jump.JmpAddress = c.Address
+						break
+					}
+				}
+				out = append(out, jump)
+				known = 0
+				continue
+			}
+		}
+		out = append(out, inst)
+		known = 0
+	}
+	pos[len(program)] = len(out)
+
+	for i := range out {
+		relocateInstruction(&out[i], pos)
+	}
+	return out
+}
+
+// evalIntrinsic returns the values pushed by intrinsic and the number of
+// arguments it pops when all of them are in known.
+func evalIntrinsic(intrinsic Intrinsic, known []Instruction) (results []int, args int, ok bool) {
+	if intrinsic == IntrinsicDup && len(known) >= 1 {
+		a := known[len(known)-1].ValueInt
+		return []int{a, a}, 1, true
+	}
+	if len(known) < 2 {
+		return nil, 0, false
+	}
+	a, b := known[len(known)-2].ValueInt, known[len(known)-1].ValueInt
+	switch intrinsic {
+	case IntrinsicPlus:
+		return []int{a + b}, 2, true
+	case IntrinsicMinus:
+		return []int{a - b}, 2, true
+	case IntrinsicTimes:
+		return []int{a * b}, 2, true
+	case IntrinsicDivMod:
+		// the division by zero is left to fail at runtime
+		if b == 0 {
+			return nil, 0, false
+		}
+		return []int{a / b, a % b}, 2, true
+	case IntrinsicGreather:
+		return []int{boolToInt(a > b)}, 2, true
+	case IntrinsicLess:
+		return []int{boolToInt(a < b)}, 2, true
+	case IntrinsicNotEqual:
+		return []int{boolToInt(a != b)}, 2, true
+	}
+	return nil, 0, false
+}
+
+// removeDeadCode drops the instructions that can't be reached from the
+// start of the program, then the jumps to the instruction that would be
+// executed next anyway. A function is reached only when it's called or
+// its address is taken, so the unused ones are removed with their skip.
+func removeDeadCode(program Program) Program {
+	live := make([]bool, len(program))
+	work := []int{0}
+	for len(work) > 0 {
+		addr := work[len(work)-1]
+		work = work[:len(work)-1]
+		if addr >= len(program) || live[addr] {
+			continue
+		}
+		live[addr] = true
+		work = append(work, successors(program, addr)...)
+	}
+
+	// landing is the address of the instruction executed when jumping
+	// to an address
+	landing := make([]int, len(program)+1)
+	landing[len(program)] = len(program)
+	for addr := len(program) - 1; addr >= 0; addr-- {
+		landing[addr] = landing[addr+1]
+		if !live[addr] {
+			continue
+		}
+		inst := program[addr]
+		if isUnconditionalJump(inst.Kind) && inst.JmpAddress > addr && landing[inst.JmpAddress] == landing[addr+1] {
+			live[addr] = false
+			continue
+		}
+		landing[addr] = addr
+	}
+
+	out := Program{}
+	pos := make(map[int]int)
+	for addr, inst := range program {
+		pos[addr] = len(out)
+		if live[addr] {
+			out = append(out, inst)
+		}
+	}
+	pos[len(program)] = len(out)
+
+	for i := range out {
+		relocateInstruction(&out[i], pos)
+	}
+	return out
+}
+
+// successors returns the addresses that can be executed after the
+// instruction at addr.
+func successors(program Program, addr int) []int {
+	inst := program[addr]
+	switch {
+	case isUnconditionalJump(inst.Kind), inst.Kind == InstKindForNext:
+		return []int{inst.JmpAddress}
+	case inst.Kind == InstKindTestCondition, inst.Kind == InstKindForTest,
+		inst.Kind == InstKindFunCall, inst.Kind == InstKindFunAddr:
+		return []int{addr + 1, inst.JmpAddress}
+	case inst.Kind == InstKindMatch:
+		next := []int{inst.JmpAddress}
+		for _, c := range inst.ValueCases {
+			next = append(next, c.Address)
+		}
+		return next
+	case inst.Kind == InstKindFunRet,
+		inst.Kind == InstKindIntrinsic && inst.ValueIntrinsic == IntrinsicExit:
+		return nil
+	}
+	return []int{addr + 1}
+}
+
+// isUnconditionalJump returns true if the given kind of instruction only
+// jumps to its JmpAddress.
+func isUnconditionalJump(kind InstKind) bool {
+	switch kind {
+	case InstKindElse, InstKindElif, InstKindCase, InstKindEnd, InstKindJump,
+		InstKindBreak, InstKindContinue, InstKindFunSkip:
+		return true
+	}
+	return false
+}
+
+// markTailCalls marks as tail calls the direct and indirect calls that
+// are followed only by jumps to the return of their function. The callee
+// reuses the return address of the caller, so a recursion in tail
+// position runs in constant return stack space.
+func markTailCalls(program Program) Program {
+	out := make(Program, len(program))
+	copy(out, program)
+	for addr, inst := range out {
+		isCall := inst.Kind == InstKindFunCall || (inst.Kind == InstKindIntrinsic && inst.ValueIntrinsic == IntrinsicCall)
+		if isCall && returnsAfter(out, addr+1) {
+			out[addr].TailCall = true
+		}
+	}
+	return out
+}
+
+// returnsAfter returns true if the execution starting at addr reaches a
+// return of the function without running other instructions.
+func returnsAfter(program Program, addr int) bool {
+	visited := make(map[int]bool)
+	for addr < len(program) && !visited[addr] {
+		visited[addr] = true
+		inst := program[addr]
+		switch {
+		case inst.Kind == InstKindFunRet:
+			return true
+		case inst.Kind == InstKindWhile:
+			addr++
+		case isUnconditionalJump(inst.Kind):
+			addr = inst.JmpAddress
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// compactMemories moves the memories used by program next to each other,
+// dropping the space of the unused ones.
+func compactMemories(program Program) Program {
+	sizes := make(map[int]int)
+	offsets := []int{}
+	for _, inst := range program {
+		if inst.Kind != InstKindMemPush {
+			continue
+		}
+		size, ok := sizes[inst.ValueMemory]
+		if !ok {
+			offsets = append(offsets, inst.ValueMemory)
+		}
+		if inst.ValueInt > size {
+			sizes[inst.ValueMemory] = inst.ValueInt
+		}
+	}
+	sort.Ints(offsets)
+
+	moved := make(map[int]int)
+	next := 0
+	for _, offset := range offsets {
+		moved[offset] = next
+		next += sizes[offset]
+	}
+
+	out := make(Program, len(program))
+	copy(out, program)
+	for i := range out {
+		if out[i].Kind == InstKindMemPush {
+			out[i].ValueMemory = moved[out[i].ValueMemory]
+		}
+	}
+	return out
+}
+
+// reportRemovedDefinitions writes to w the functions, the memories and
+// the number of string literals of before that are not used in after.
+func reportRemovedDefinitions(w io.Writer, before Program, after Program, memories map[string]memoryBlock) {
+	// the functions are told apart by their location, different files
+	// can define functions with the same name
+	keptFuns := make(map[fileLocation]bool)
+	keptMems := make(map[int]bool)
+	strings := 0
+	for _, inst := range after {
+		switch inst.Kind {
+		case InstKindFunDef:
+			keptFuns[inst.token.location] = true
+		case InstKindMemPush:
+			keptMems[inst.ValueMemory] = true
+		case InstKindPushString:
+			strings--
+		}
+	}
+
+	for _, inst := range before {
+		switch inst.Kind {
+		case InstKindFunDef:
+			if !keptFuns[inst.token.location] {
+				fmt.Fprintf(w, "%s: info: unused function '%s' removed\n", inst.token.location, inst.ValueString)
+			}
+		case InstKindPushString:
+			strings++
+		}
+	}
+
+	names := make([]string, 0, len(memories))
+	for name := range memories {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := memories[names[i]], memories[names[j]]
+		if a.offset != b.offset {
+			return a.offset < b.offset
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		if mem := memories[name]; !keptMems[mem.offset] {
+			fmt.Fprintf(w, "%s: info: unused memory '%s' removed\n", mem.token.location, mem.token.value)
+		}
+	}
+
+	if strings > 0 {
+		fmt.Fprintf(w, "info: %d unused string literals removed\n", strings)
+	}
+}
@@ -0,0 +1,45 @@
+package tin
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestTailCallsReturnStack runs a recursion a million calls deep with a
+// return stack of 8 values, it overflows unless the calls in tail
+// position are turned into jumps.
+func TestTailCallsReturnStack(t *testing.T) {
+	source := `
+def count
+    dup 0 > if 1 - count end
+end
+def int_to_int 1 * end
+memory count_addr 8 end
+def count_by_address
+    dup 0 > if 1 - count_addr @64 cast(int_to_int) call end
+end
+&count_by_address count_addr !64
+1000000 count print
+1000000 count_by_address print
+`
+	path := filepath.Join(t.TempDir(), "tail.tin")
+	if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, level := range []int{0, 1} {
+		option := CompilerOption{InputPath: path, OptimizationLevel: level, ReturnStackSize: 64}
+		program := load(t, option, TargetSimulator)
+		if stdout, _, exitCode := simulate(option, program); stdout != "0\n0\n" || exitCode != 0 {
+			t.Errorf("-O%d: the recursion printed %q and exited with %d, want \"0\\n0\\n\" and 0", level, stdout, exitCode)
+		}
+
+		for addr := range program {
+			program[addr].TailCall = false
+		}
+		if _, _, exitCode := simulate(option, program); exitCode != 1 {
+			t.Errorf("-O%d: the recursion without tail calls exited with %d, want the overflow", level, exitCode)
+		}
+	}
+}
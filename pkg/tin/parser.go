@@ -1,9 +1,13 @@
 package tin
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -11,25 +15,105 @@ const (
 )
 
 type parser struct {
-	ip             int
-	ipStack        []int
-	funStack       map[string]int
-	memoryStack    map[string]int
-	memoryCapacity int
-	constStack     map[string]int
-	includeLevel   int
+	ip              int
+	ipStack         []int
+	funStack        map[string]int
+	memoryStack     map[string]memoryBlock
+	memoryCapacity  int
+	constStack      map[string]int
+	structStack     map[string]int
+	fieldStack      map[string]structField
+	enumStack       map[string]enumType
+	dataStack       map[string]DataBlock
+	loopStack       []loop
+	macroStack      map[string]macro
+	macroExpansions int
+	inlineNextDef   bool
+	privateNextDef  bool
+	stripAsserts    bool
+	includeLevel    int
+	// prefix of the names defined in the file being parsed, it's empty
+	// for the main file
+	namespace string
+	// files included by the program, by moduleKey
+	modules map[string]*module
+	// definitions of the included files visible in a namespace, by the
+	// name they are used with
+	imports map[string][]string
 }
 
-func (p *parser) parseProgramFromTokens(tokens []token) (program Program) {
+// loop keeps track of a 'while' or a 'for' that is being parsed, so that
+// 'break' and 'continue' know where to jump.
+type loop struct {
+	startAddr     int
+	isFor         bool
+	breakAddrs    []int
+	continueAddrs []int
+}
+
+// module is an included file, it's parsed once and the files including
+// it see its public names.
+type module struct {
+	// path of the first include of the file
+	path      string
+	namespace string
+	names     []string
+}
+
+// enumType is an enum with the name it's declared with, its members are
+// defined as consts.
+type enumType struct {
+	name    string
+	members []string
+}
+
+type structField struct {
+	offset int
+	size   int
+	// the field is a struct, its size is sizeof(...) and it's accessed
+	// adding its offset to the pointer
+	nested bool
+}
+
+type memoryBlock struct {
+	offset int
+	size   int
+	token  token
+}
+
+// parseProgramFromTokens parses the given tokens appending the resulting
+// instructions to program.
+func (p *parser) parseProgramFromTokens(program Program, tokens []token) Program {
 	if p.funStack == nil {
 		p.funStack = make(map[string]int)
 	}
 	if p.memoryStack == nil {
-		p.memoryStack = make(map[string]int)
+		p.memoryStack = make(map[string]memoryBlock)
 	}
 	if p.constStack == nil {
 		p.constStack = make(map[string]int)
 	}
+	if p.structStack == nil {
+		p.structStack = make(map[string]int)
+	}
+	if p.fieldStack == nil {
+		p.fieldStack = make(map[string]structField)
+	}
+	if p.enumStack == nil {
+		p.enumStack = make(map[string]enumType)
+	}
+	if p.dataStack == nil {
+		p.dataStack = make(map[string]DataBlock)
+	}
+	if p.macroStack == nil {
+		p.macroStack = make(map[string]macro)
+	}
+	if p.modules == nil {
+		p.modules = make(map[string]*module)
+	}
+	if p.imports == nil {
+		p.imports = make(map[string][]string)
+	}
 
 	for len(tokens) > 0 {
 		switch tokens[0].kind {
@@ -68,6 +152,22 @@ func (p *parser) parseProgramFromTokens(tokens []token) (program Program) {
 				if len(p.ipStack) == 0 {
 					panic("cannot parse the else of a non existing if")
 				}
+				if kind := program[p.ipStack[len(p.ipStack)-1]].Kind; kind == InstKindMatch || kind == InstKindCase {
+					// the default arm of a match
+					matchAddr := p.currentMatchAddr(program)
+					if program[matchAddr].JmpAddress != 0 {
+						panic(fmt.Sprintf("%s: 'match' with more than one 'else'", tokens[0].location))
+					}
+					program = append(program, Instruction{
+						Kind:  InstKindCase,
+						token: tokens[0],
+					})
+					tokens = tokens[1:]
+					p.ipStack = append(p.ipStack, p.ip)
+					p.ip++
+					program[matchAddr].JmpAddress = p.ip
+					break
+				}
 				if_addr := p.ipStack[len(p.ipStack)-1]
 				p.ipStack = p.ipStack[:len(p.ipStack)-1]
 				p.ipStack = append(p.ipStack, p.ip)
@@ -78,6 +178,69 @@ func (p *parser) parseProgramFromTokens(tokens []token) (program Program) {
 				tokens = tokens[1:]
 				program[if_addr].JmpAddress = p.ip + 1
 				p.ip++
+			case "elif":
+				if len(p.ipStack) < 1 || program[p.ipStack[len(p.ipStack)-1]].Kind != InstKindTestCondition ||
+					(len(p.ipStack) > 1 && program[p.ipStack[len(p.ipStack)-2]].Kind == InstKindWhile) {
+					panic(fmt.Sprintf("%s: 'elif' used without a preceding 'if'", tokens[0].location))
+				}
+				testAddr := p.ipStack[len(p.ipStack)-1]
+				p.ipStack = p.ipStack[:len(p.ipStack)-1]
+				p.ipStack = append(p.ipStack, p.ip)
+				program = append(program, Instruction{
+					Kind:  InstKindElif,
+					token: tokens[0],
+				})
+				tokens = tokens[1:]
+				program[testAddr].JmpAddress = p.ip + 1
+				p.ip++
+			case "match":
+				program = append(program, Instruction{
+					Kind:  InstKindMatch,
+					token: tokens[0],
+				})
+				tokens = tokens[1:]
+				p.ipStack = append(p.ipStack, p.ip)
+				p.ip++
+				if len(tokens) == 0 || tokens[0].value != "case" {
+					panic(fmt.Sprintf("%s: expected a 'case' after 'match'", program[len(program)-1].token.location))
+				}
+			case "case":
+				if len(p.ipStack) == 0 {
+					panic(fmt.Sprintf("%s: 'case' used without a preceding 'match'", tokens[0].location))
+				}
+				if kind := program[p.ipStack[len(p.ipStack)-1]].Kind; kind != InstKindMatch && kind != InstKindCase {
+					panic(fmt.Sprintf("%s: 'case' used without a preceding 'match'", tokens[0].location))
+				}
+				matchAddr := p.currentMatchAddr(program)
+				if program[matchAddr].JmpAddress != 0 {
+					panic(fmt.Sprintf("%s: 'case' used after the 'else' of a 'match'", tokens[0].location))
+				}
+				caseToken := tokens[0]
+				tokens = tokens[1:]
+				if len(program[matchAddr].ValueCases) > 0 {
+					// jump from the end of the previous case to the end of the match
+					program = append(program, Instruction{
+						Kind:  InstKindCase,
+						token: caseToken,
+					})
+					p.ipStack = append(p.ipStack, p.ip)
+					p.ip++
+				}
+
+				if len(tokens) == 0 {
+					panic(fmt.Sprintf("%s: expected a value after 'case'", caseToken.location))
+				}
+				caseValue := p.evalConstToken(tokens[0])
+				for _, c := range program[matchAddr].ValueCases {
+					if c.Value == caseValue {
+						panic(fmt.Sprintf("%s: duplicate case %s in 'match'", caseToken.location, p.describeConst(tokens[0], caseValue)))
+					}
+				}
+				tokens = tokens[1:]
+				program[matchAddr].ValueCases = append(program[matchAddr].ValueCases, MatchCase{
+					Value:   caseValue,
+					Address: p.ip,
+				})
 			case "while":
 				program = append(program, Instruction{
 					Kind:  InstKindWhile,
@@ -85,6 +248,95 @@ func (p *parser) parseProgramFromTokens(tokens []token) (program Program) {
 				})
 				tokens = tokens[1:]
 				p.ipStack = append(p.ipStack, p.ip)
+				p.loopStack = append(p.loopStack, loop{startAddr: p.ip})
+				p.ip++
+			case "break", "continue":
+				if len(p.loopStack) == 0 || p.loopStack[len(p.loopStack)-1].startAddr < p.currentFunAddr(program) {
+					panic(fmt.Sprintf("%s: '%s' used outside of a loop", tokens[0].location, keyword))
+				}
+				currentLoop := &p.loopStack[len(p.loopStack)-1]
+				if keyword == "break" {
+					program = append(program, Instruction{
+						Kind:  InstKindBreak,
+						token: tokens[0],
+					})
+					currentLoop.breakAddrs = append(currentLoop.breakAddrs, p.ip)
+				} else if currentLoop.isFor {
+					// the step of the loop is not parsed yet
+					program = append(program, Instruction{
+						Kind:  InstKindContinue,
+						token: tokens[0],
+					})
+					currentLoop.continueAddrs = append(currentLoop.continueAddrs, p.ip)
+				} else {
+					program = append(program, Instruction{
+						Kind:       InstKindContinue,
+						token:      tokens[0],
+						JmpAddress: currentLoop.startAddr,
+					})
+				}
+				tokens = tokens[1:]
+				p.ip++
+			case "return":
+				funAddr := p.currentFunAddr(program)
+				if funAddr < 0 {
+					panic(fmt.Sprintf("%s: 'return' used outside of a 'def'", tokens[0].location))
+				}
+				// restore the counters of the 'for' loops we are leaving
+				for i := len(p.loopStack) - 1; i >= 0 && p.loopStack[i].startAddr > funAddr; i-- {
+					if p.loopStack[i].isFor {
+						program = append(program, Instruction{
+							Kind:  InstKindForEnd,
+							token: tokens[0],
+						})
+						p.ip++
+					}
+				}
+				program = append(program, Instruction{
+					Kind:  InstKindFunRet,
+					token: tokens[0],
+				})
+				tokens = tokens[1:]
+				p.ip++
+			case "for":
+				forToken := tokens[0]
+				tokens = tokens[1:]
+				step := 1
+				reverse := false
+				for len(tokens) > 0 && tokens[0].kind == tokenKindWord {
+					if tokens[0].value == "reverse" {
+						reverse = true
+						tokens = tokens[1:]
+					} else if tokens[0].value == "step" {
+						if len(tokens) < 2 {
+							panic(fmt.Sprintf("%s: expected a value after 'step'", tokens[0].location))
+						}
+						step = p.evalConstToken(tokens[1])
+						if step <= 0 {
+							panic(fmt.Sprintf("%s: the step of a 'for' must be positive, it's %s", tokens[1].location, p.describeConst(tokens[1], step)))
+						}
+						tokens = tokens[2:]
+					} else {
+						break
+					}
+				}
+				if reverse {
+					step = -step
+				}
+
+				program = append(program, Instruction{
+					Kind:     InstKindForStart,
+					ValueInt: step,
+					token:    forToken,
+				})
+				p.ip++
+				program = append(program, Instruction{
+					Kind:     InstKindForTest,
+					ValueInt: step,
+					token:    forToken,
+				})
+				p.ipStack = append(p.ipStack, p.ip)
+				p.loopStack = append(p.loopStack, loop{startAddr: p.ip, isFor: true})
 				p.ip++
 			case "do":
 				if len(p.ipStack) == 0 {
@@ -109,7 +361,13 @@ func (p *parser) parseProgramFromTokens(tokens []token) (program Program) {
 					endJmpAddr := p.ip + 1
 					if len(p.ipStack) > 0 && program[p.ipStack[len(p.ipStack)-1]].Kind == InstKindWhile {
 						endJmpAddr = p.ipStack[len(p.ipStack)-1]
-						p.ipStack = p.ipStack[1:]
+						p.ipStack = p.ipStack[:len(p.ipStack)-1]
+
+						endedLoop := p.loopStack[len(p.loopStack)-1]
+						p.loopStack = p.loopStack[:len(p.loopStack)-1]
+						for _, breakAddr := range endedLoop.breakAddrs {
+							program[breakAddr].JmpAddress = p.ip + 1
+						}
 					}
 					program[prec_addr].JmpAddress = p.ip + 1
 
@@ -119,6 +377,29 @@ func (p *parser) parseProgramFromTokens(tokens []token) (program Program) {
 						JmpAddress: endJmpAddr,
 					})
 					tokens = tokens[1:]
+				case InstKindForTest:
+					endedLoop := p.loopStack[len(p.loopStack)-1]
+					p.loopStack = p.loopStack[:len(p.loopStack)-1]
+					for _, continueAddr := range endedLoop.continueAddrs {
+						program[continueAddr].JmpAddress = p.ip
+					}
+					program = append(program, Instruction{
+						Kind:       InstKindForNext,
+						token:      tokens[0],
+						ValueInt:   program[prec_addr].ValueInt,
+						JmpAddress: prec_addr,
+					})
+					p.ip++
+
+					for _, breakAddr := range endedLoop.breakAddrs {
+						program[breakAddr].JmpAddress = p.ip
+					}
+					program[prec_addr].JmpAddress = p.ip
+					program = append(program, Instruction{
+						Kind:  InstKindForEnd,
+						token: tokens[0],
+					})
+					tokens = tokens[1:]
 				case InstKindElse:
 					program[prec_addr].JmpAddress = p.ip + 1
 					program = append(program, Instruction{
@@ -134,19 +415,57 @@ func (p *parser) parseProgramFromTokens(tokens []token) (program Program) {
 						token: tokens[0],
 					})
 					tokens = tokens[1:]
+				case InstKindMatch, InstKindCase:
+					p.ipStack = append(p.ipStack, prec_addr)
+					for program[p.ipStack[len(p.ipStack)-1]].Kind == InstKindCase {
+						program[p.ipStack[len(p.ipStack)-1]].JmpAddress = p.ip + 1
+						p.ipStack = p.ipStack[:len(p.ipStack)-1]
+					}
+					matchAddr := p.ipStack[len(p.ipStack)-1]
+					p.ipStack = p.ipStack[:len(p.ipStack)-1]
+					if program[matchAddr].JmpAddress == 0 {
+						// no else, the default case does nothing
+						program[matchAddr].JmpAddress = p.ip + 1
+					}
+					program = append(program, Instruction{
+						Kind:       InstKindEnd,
+						token:      tokens[0],
+						JmpAddress: p.ip + 1,
+					})
+					tokens = tokens[1:]
 				default:
 					panic(fmt.Sprintf("unexpected keyword '%s' as the preceder of 'end'", program[prec_addr].Kind))
 				}
+				// close all the 'elif' of the chain
+				for len(p.ipStack) > 0 && program[p.ipStack[len(p.ipStack)-1]].Kind == InstKindElif {
+					program[p.ipStack[len(p.ipStack)-1]].JmpAddress = p.ip + 1
+					p.ipStack = p.ipStack[:len(p.ipStack)-1]
+				}
 				p.ip++
+			case "inline":
+				if len(tokens) < 2 || tokens[1].value != "def" {
+					panic(fmt.Sprintf("%s: 'inline' must be followed by 'def'", tokens[0].location))
+				}
+				tokens = tokens[1:]
+				p.inlineNextDef = true
+			case "private":
+				if len(tokens) < 2 || tokens[1].kind != tokenKindKeyword ||
+					!(definitionKeywords[tokens[1].value] || tokens[1].value == "inline") {
+					panic(fmt.Sprintf("%s: 'private' must be followed by a definition", tokens[0].location))
+				}
+				tokens = tokens[1:]
+				p.privateNextDef = true
 			case "def":
 				program = append(program, Instruction{
 					Kind:  InstKindFunSkip,
 					token: tokens[0],
 				})
 				program = append(program, Instruction{
-					Kind:  InstKindFunDef,
-					token: tokens[0],
+					Kind:   InstKindFunDef,
+					token:  tokens[0],
+					Inline: p.inlineNextDef,
 				})
+				p.inlineNextDef = false
 				tokens = tokens[1:]
 				p.ipStack = append(p.ipStack, p.ip)
 				p.ip++
@@ -154,40 +473,200 @@ func (p *parser) parseProgramFromTokens(tokens []token) (program Program) {
 				if len(tokens) == 0 {
 					panic("'def' used without a name")
 				}
-				funName := tokens[0].value
-				tokens = tokens[1:]
-				p.checkNameRedefinition(funName)
+				funName := p.define(tokens[0])
 				p.funStack[funName] = p.ip
+				// the name without the namespace, like the user sees it
+				program[p.ip].ValueString = tokens[0].value
+				tokens = tokens[1:]
 				p.ip++
 			case "memory":
 				tokens = tokens[1:]
 				if len(tokens) == 0 {
 					panic("'memory' used without a name")
 				}
-				memName := tokens[0].value
+				memToken := tokens[0]
+				memName := p.define(memToken)
 				tokens = tokens[1:]
-				p.checkNameRedefinition(memName)
 				if len(tokens) == 0 {
 					panic("expecting a memory size")
 				}
-				memSize := tokens[0]
+				memSize := p.evalConstValue(&tokens)
+				if memSize < 0 {
+					panic(fmt.Sprintf("%s: memory '%s' has a negative size", memToken.location, memToken.value))
+				}
+				p.memoryStack[memName] = memoryBlock{offset: p.memoryCapacity, size: memSize, token: memToken}
+				p.memoryCapacity += memSize
+			case "const":
+				tokens = tokens[1:]
+				constName := p.define(tokens[0])
+				tokens = tokens[1:]
+				p.constStack[constName] = p.evalConstValue(&tokens)
+			case "struct":
+				tokens = tokens[1:]
+				if len(tokens) == 0 {
+					panic("'struct' used without a name")
+				}
+				structToken := tokens[0]
+				structName := p.define(structToken)
+				tokens = tokens[1:]
+
+				offset := 0
+				for len(tokens) > 0 && tokens[0].value != "end" {
+					if tokens[0].kind != tokenKindWord {
+						panic(fmt.Sprintf("%s: expected a field name in struct '%s'", tokens[0].location, structToken.value))
+					}
+					fieldToken := tokens[0]
+					fieldToken.value = structToken.value + "." + fieldToken.value
+					fieldName := p.qualify(fieldToken)
+					tokens = tokens[1:]
+					if len(tokens) == 0 {
+						panic(fmt.Sprintf("%s: expecting a size for field '%s'", fieldToken.location, fieldToken.value))
+					}
+					sizeToken := tokens[0]
+					fieldSize := p.evalConstToken(sizeToken)
+					tokens = tokens[1:]
+					nested := strings.HasPrefix(sizeToken.value, "sizeof(")
+					if fieldSize <= 0 {
+						panic(fmt.Sprintf("%s: field '%s' must have a positive size", fieldToken.location, fieldToken.value))
+					}
+					if !nested && fieldSize != 1 && fieldSize != 4 && fieldSize != 8 {
+						panic(fmt.Sprintf("%s: field '%s' has size %d, it must be 1, 4, 8 or the size of a struct", fieldToken.location, fieldToken.value, fieldSize))
+					}
+
+					p.checkNameRedefinition(fieldName, fieldToken)
+					p.constStack[fieldName] = offset
+					p.fieldStack[fieldName] = structField{offset: offset, size: fieldSize, nested: nested}
+					offset += fieldSize
+				}
+				if len(tokens) == 0 {
+					panic("'struct' used whitout an end")
+				}
+				tokens = tokens[1:]
+
+				sizeName := fmt.Sprintf("sizeof(%s)", structName)
+				sizeToken := structToken
+				sizeToken.value = fmt.Sprintf("sizeof(%s)", structToken.value)
+				p.checkNameRedefinition(sizeName, sizeToken)
+				p.structStack[structName] = offset
+				p.constStack[sizeName] = offset
+			case "enum":
+				tokens = tokens[1:]
+				if len(tokens) == 0 {
+					panic("'enum' used without a name")
+				}
+				enumToken := tokens[0]
+				enumName := p.define(enumToken)
+				tokens = tokens[1:]
+
+				enum := enumType{name: enumToken.value}
+				value := 0
+				// count is one more than the largest value, the size of a
+				// table indexed by the members
+				count := 0
+				for len(tokens) > 0 && tokens[0].value != "end" {
+					switch tokens[0].kind {
+					case tokenKindIntLit:
+						// an explicit value for the next member
+						value = p.evalConstToken(tokens[0])
+					case tokenKindWord:
+						memberName := p.define(tokens[0])
+						p.constStack[memberName] = value
+						enum.members = append(enum.members, memberName)
+						if value+1 > count {
+							count = value + 1
+						}
+						value++
+					default:
+						panic(fmt.Sprintf("%s: expected a member name in enum '%s'", tokens[0].location, enumToken.value))
+					}
+					tokens = tokens[1:]
+				}
+				if len(tokens) == 0 {
+					panic("'enum' used whitout an end")
+				}
+				tokens = tokens[1:]
+
+				countToken := enumToken
+				countToken.value = enumToken.value + ".count"
+				countName := p.define(countToken)
+				p.constStack[countName] = count
+				p.enumStack[enumName] = enum
+			case "data", "rodata":
+				tokens = tokens[1:]
+				if len(tokens) == 0 {
+					panic(fmt.Sprintf("'%s' used without a name", keyword))
+				}
+				dataName := p.define(tokens[0])
+				tokens = tokens[1:]
+				p.dataStack[dataName] = DataBlock{
+					Name:     dataName,
+					Bytes:    p.parseDataBytes(&tokens),
+					ReadOnly: keyword == "rodata",
+				}
+			case "embed":
+				embedToken := tokens[0]
 				tokens = tokens[1:]
-				if len(tokens) == 0 || tokens[0].value != "end" {
-					panic("'memory' used whitout an end")
+				if len(tokens) == 0 || tokens[0].kind != tokenKindStringLit {
+					panic(fmt.Sprintf("%s: expected a file path after embed", embedToken.location))
 				}
+				embedPath := tokens[0].value
 				tokens = tokens[1:]
-				memSizeInt, err := strconv.ParseUint(memSize.value, 10, 64)
+				content, err := ioutil.ReadFile(embedPath)
 				if err != nil {
 					panic(err)
 				}
-				p.memoryStack[memName] = p.memoryCapacity
-				p.memoryCapacity += int(memSizeInt)
-			case "const":
+				program = append(program, Instruction{
+					Kind:     InstKindPushInt,
+					ValueInt: len(content),
+					token:    embedToken,
+				})
+				program = append(program, Instruction{
+					Kind: InstKindDataPush,
+					ValueData: DataBlock{
+						Name:     fmt.Sprintf("embed(%s)", embedPath),
+						Bytes:    content,
+						ReadOnly: true,
+					},
+					token: embedToken,
+				})
+				p.ip += 2
+			case "macro":
+				macroToken := tokens[0]
 				tokens = tokens[1:]
-				constName := tokens[0].value
+				m := parseMacroDefinition(&tokens, macroToken.location)
+				if _, isIntrinsic := intrinsicMap[m.name]; isIntrinsic {
+					panic(fmt.Sprintf("%s: macro '%s' redefines an intrinsic", macroToken.location, m.name))
+				}
+				p.macroStack[p.define(token{value: m.name, location: macroToken.location})] = m
+			case "static":
+				if len(tokens) < 2 || tokens[1].value != "if" {
+					panic(fmt.Sprintf("%s: 'static' must be followed by 'if'", tokens[0].location))
+				}
+				branches, rest := splitStaticIf(tokens[2:], tokens[0].location)
+				tokens = rest
+				for _, branch := range branches {
+					if branch.isElse || p.evalConstValue(&branch.cond) != 0 {
+						// only the tokens of the taken branch are parsed
+						tokens = append(append([]token{}, branch.body...), rest...)
+						break
+					}
+				}
+			case "static_assert":
+				assertToken := tokens[0]
 				tokens = tokens[1:]
-				p.checkNameRedefinition(constName)
-				p.constStack[constName] = p.evalConstValue(&tokens)
+				var cond []token
+				for len(tokens) > 0 && tokens[0].kind != tokenKindStringLit {
+					cond = append(cond, tokens[0])
+					tokens = tokens[1:]
+				}
+				if len(tokens) < 2 || tokens[1].value != "end" {
+					panic(fmt.Sprintf("%s: expected a message and an end after the static_assert condition", assertToken.location))
+				}
+				message := tokens[0].value
+				tokens = tokens[2:]
+				if p.evalConstValue(&cond) == 0 {
+					panic(fmt.Sprintf("%s: static assertion failed: %s", assertToken.location, message))
+				}
 			case "include":
 				tokens = tokens[1:]
 				if len(tokens) == 0 || tokens[0].kind != tokenKindStringLit {
@@ -195,22 +674,46 @@ func (p *parser) parseProgramFromTokens(tokens []token) (program Program) {
 				}
 				includePath := tokens[0].value
 				tokens = tokens[1:]
+				// the names of the file are used as they are or, with
+				// 'as x', as 'x.name'
+				alias := p.namespace
+				if len(tokens) > 0 && tokens[0].kind == tokenKindWord && tokens[0].value == "as" {
+					if len(tokens) < 2 || tokens[1].kind != tokenKindWord || strings.ContainsAny(tokens[1].value, ".@!&()") {
+						panic(fmt.Sprintf("%s: expected a namespace name after 'as'", tokens[0].location))
+					}
+					alias = p.namespace + tokens[1].value + "."
+					tokens = tokens[2:]
+				}
 
-				if p.includeLevel+1 > maxIncludeLevel {
-					panic("max include lever reached")
+				// the file is parsed once in its own namespace, every
+				// include shares its code and memories
+				mod, parsed := p.modules[moduleKey(includePath)]
+				if !parsed {
+					mod = &module{path: includePath, namespace: modulePrefix(includePath)}
+					p.modules[moduleKey(includePath)] = mod
+					program = p.parseInclude(program, includePath, mod.namespace)
+					mod.names = p.publicNames(mod.namespace)
 				}
-				p.includeLevel++
-				source, err := ioutil.ReadFile(includePath)
-				if err != nil {
-					panic(err)
+				for _, name := range mod.names {
+					p.importName(alias+strings.TrimPrefix(name, mod.namespace), name)
 				}
-				tokens := tokenizeSource(string(source), includePath)
-				program = append(program, p.parseProgramFromTokens(tokens)...)
-				p.includeLevel--
 			default:
 				panic(fmt.Sprintf("unknown keyword '%s'", keyword))
 			}
+			if definitionKeywords[keyword] {
+				p.privateNextDef = false
+			}
 		case tokenKindWord:
+			word := p.resolve(tokens[0])
+			if tokens[0].value == "i" && p.isDefined(word) && p.insideFor(program) {
+				// the counter would hide the definition
+				panic(fmt.Sprintf("%s: 'i' is both the counter of the 'for' and a name defined by the program, rename the definition", tokens[0].location))
+			}
+			if m, ok := p.macroStack[word]; ok {
+				// a macro, replace it with its body
+				tokens = p.expandMacro(m, tokens[0], tokens[1:])
+				continue
+			}
 			intrinsic, exist := intrinsicMap[tokens[0].value]
 			// word is an intrinsic
 			if exist {
@@ -222,7 +725,7 @@ func (p *parser) parseProgramFromTokens(tokens []token) (program Program) {
 				tokens = tokens[1:]
 				p.ip++
 			} else {
-				if fun_addr, ok := p.funStack[tokens[0].value]; ok {
+				if fun_addr, ok := p.funStack[word]; ok {
 					// a function call
 					program = append(program, Instruction{
 						Kind:       InstKindFunCall,
@@ -231,16 +734,66 @@ func (p *parser) parseProgramFromTokens(tokens []token) (program Program) {
 					})
 					tokens = tokens[1:]
 					p.ip++
-				} else if mem_offset, ok := p.memoryStack[tokens[0].value]; ok {
+				} else if mem, ok := p.memoryStack[word]; ok {
 					// a memory allocation
 					program = append(program, Instruction{
 						Kind:        InstKindMemPush,
-						ValueMemory: mem_offset,
+						ValueMemory: mem.offset,
+						ValueInt:    mem.size,
 						token:       tokens[0],
 					})
 					tokens = tokens[1:]
 					p.ip++
-				} else if const_val, ok := p.constStack[tokens[0].value]; ok {
+				} else if fun_addr, ok := p.lookupFunReference(tokens[0], "&", ""); ok {
+					// the address of a function
+					program = append(program, Instruction{
+						Kind:       InstKindFunAddr,
+						JmpAddress: fun_addr,
+						token:      tokens[0],
+					})
+					tokens = tokens[1:]
+					p.ip++
+				} else if fun_addr, ok := p.lookupFunReference(tokens[0], "cast(", ")"); ok {
+					// a value with the same type of a function
+					program = append(program, Instruction{
+						Kind:       InstKindFunCast,
+						JmpAddress: fun_addr,
+						token:      tokens[0],
+					})
+					tokens = tokens[1:]
+					p.ip++
+				} else if tokens[0].value == "assert" {
+					// a runtime assertion, release builds only drop the
+					// condition and the message
+					inst := Instruction{
+						Kind:  InstKindAssert,
+						token: tokens[0],
+					}
+					if p.stripAsserts {
+						inst.Kind = InstKindDrop
+						inst.ValueInt = 3
+					}
+					program = append(program, inst)
+					tokens = tokens[1:]
+					p.ip++
+				} else if tokens[0].value == "i" && p.insideFor(program) {
+					// the counter of the innermost 'for'
+					program = append(program, Instruction{
+						Kind:  InstKindForIndex,
+						token: tokens[0],
+					})
+					tokens = tokens[1:]
+					p.ip++
+				} else if data, ok := p.dataStack[word]; ok {
+					// an initialized data block
+					program = append(program, Instruction{
+						Kind:      InstKindDataPush,
+						ValueData: data,
+						token:     tokens[0],
+					})
+					tokens = tokens[1:]
+					p.ip++
+				} else if const_val, ok := p.constStack[word]; ok {
 					// a const declaration
 					program = append(program, Instruction{
 						Kind:     InstKindPushInt,
@@ -248,6 +801,11 @@ func (p *parser) parseProgramFromTokens(tokens []token) (program Program) {
 						token:    tokens[0],
 					})
 					tokens = tokens[1:]
+					p.ip++
+				} else if field, isLoad, ok := p.lookupFieldAccessor(tokens[0]); ok {
+					// a struct field accessor
+					program = append(program, p.fieldAccessor(field, isLoad, tokens[0])...)
+					tokens = tokens[1:]
 				} else {
 					panic(fmt.Sprintf("%s: unknown word '%s'", tokens[0].location, tokens[0].value))
 				}
@@ -270,11 +828,7 @@ evalLoop:
 
 		switch token.kind {
 		case tokenKindIntLit:
-			intVal, err := strconv.ParseUint(token.value, 10, 64)
-			if err != nil {
-				panic(err)
-			}
-			stack = append(stack, int(intVal))
+			stack = append(stack, p.evalConstToken(token))
 		case tokenKindKeyword:
 			if token.value == "end" {
 				break evalLoop
@@ -286,24 +840,39 @@ evalLoop:
 					panic("wrong number of operations for + in compile time evaluation")
 				}
 				newVal := stack[len(stack)-2] + stack[len(stack)-1]
-				stack = stack[1:]
+				stack = stack[:len(stack)-1]
 				stack[len(stack)-1] = newVal
 			} else if token.value == "-" {
 				if len(stack) < 2 {
 					panic("wrong number of operations for - in compile time evaluation")
 				}
 				newVal := stack[len(stack)-2] - stack[len(stack)-1]
-				stack = stack[1:]
+				stack = stack[:len(stack)-1]
 				stack[len(stack)-1] = newVal
 			} else if token.value == "*" {
 				if len(stack) < 2 {
 					panic("wrong number of operations for * in compile time evaluation")
 				}
 				newVal := stack[len(stack)-2] * stack[len(stack)-1]
-				stack = stack[1:]
+				stack = stack[:len(stack)-1]
 				stack[len(stack)-1] = newVal
-			} else if constVal, ok := p.constStack[token.value]; ok {
-				stack = append(stack, constVal)
+			} else if token.value == "<" || token.value == ">" || token.value == "!=" {
+				if len(stack) < 2 {
+					panic(fmt.Sprintf("wrong number of operations for %s in compile time evaluation", token.value))
+				}
+				a, b := stack[len(stack)-2], stack[len(stack)-1]
+				result := (token.value == "<" && a < b) || (token.value == ">" && a > b) || (token.value == "!=" && a != b)
+				stack = stack[:len(stack)-1]
+				stack[len(stack)-1] = boolToInt(result)
+			} else if token.value == "defined?" {
+				// pushes 1 if the following name is defined, 0 otherwise
+				if len(*tokens) == 0 || (*tokens)[0].kind != tokenKindWord {
+					panic(fmt.Sprintf("%s: expected a name after 'defined?'", token.location))
+				}
+				stack = append(stack, boolToInt(p.isDefined(p.resolve((*tokens)[0]))))
+				*tokens = (*tokens)[1:]
+			} else if _, ok := p.constStack[p.resolve(token)]; ok {
+				stack = append(stack, p.evalConstToken(token))
 			} else {
 				panic(fmt.Sprintf("unsupported word %s in compile time evaluation", token.value))
 			}
@@ -318,11 +887,392 @@ evalLoop:
 	return stack[0]
 }
 
-func (p parser) checkNameRedefinition(name string) {
+// currentFunAddr returns the address of the innermost 'def' that is being
+// parsed or -1 if we are at the top level.
+func (p parser) currentFunAddr(program Program) int {
+	for i := len(p.ipStack) - 1; i >= 0; i-- {
+		if program[p.ipStack[i]].Kind == InstKindFunSkip {
+			return p.ipStack[i]
+		}
+	}
+	return -1
+}
+
+// lookupFunReference checks if word is the name of a function between
+// the given prefix and suffix, like '&name' or 'cast(name)'.
+func (p parser) lookupFunReference(tok token, prefix string, suffix string) (int, bool) {
+	word := tok.value
+	if !strings.HasPrefix(word, prefix) || !strings.HasSuffix(word, suffix) || len(word) <= len(prefix)+len(suffix) {
+		return 0, false
+	}
+	tok.value = word[len(prefix) : len(word)-len(suffix)]
+	addr, ok := p.funStack[p.resolve(tok)]
+	return addr, ok
+}
+
+// insideFor returns true if we are parsing the body of a 'for' of the
+// current function.
+func (p parser) insideFor(program Program) bool {
+	funAddr := p.currentFunAddr(program)
+	for i := len(p.loopStack) - 1; i >= 0 && p.loopStack[i].startAddr > funAddr; i-- {
+		if p.loopStack[i].isFor {
+			return true
+		}
+	}
+	return false
+}
+
+// currentMatchAddr returns the address of the innermost 'match' that is
+// being parsed.
+func (p parser) currentMatchAddr(program Program) int {
+	for i := len(p.ipStack) - 1; i >= 0; i-- {
+		if program[p.ipStack[i]].Kind == InstKindMatch {
+			return p.ipStack[i]
+		}
+	}
+	panic("there is no 'match' being parsed")
+}
+
+// evalConstToken evaluates a single token that is either an integer
+// literal or the name of an already defined const.
+func (p parser) evalConstToken(token token) int {
+	switch token.kind {
+	case tokenKindIntLit:
+		intVal, err := strconv.ParseUint(token.value, 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		return int(intVal)
+	case tokenKindWord:
+		if constVal, ok := p.constStack[p.resolve(token)]; ok {
+			return constVal
+		}
+	}
+	panic(fmt.Sprintf("%s: '%s' is not a compile time constant", token.location, token.value))
+}
+
+// describeConst returns how the value of the const token is written in
+// the diagnostics: the number, preceded by the name when the token is
+// one and by the enum when the name is one of its members.
+func (p parser) describeConst(tok token, value int) string {
+	if tok.kind != tokenKindWord {
+		return fmt.Sprint(value)
+	}
+	name := p.resolve(tok)
+	for _, enum := range p.enumStack {
+		for _, member := range enum.members {
+			if member == name {
+				return fmt.Sprintf("'%s' (%d of enum '%s')", tok.value, value, enum.name)
+			}
+		}
+	}
+	return fmt.Sprintf("'%s' (%d)", tok.value, value)
+}
+
+// parseDataBytes reads the content of a data block up to its 'end'.
+// The words db, dw, dd and dq set the size in bytes of the following
+// values, string literals are copied as they are.
+func (p parser) parseDataBytes(tokens *[]token) (out []byte) {
+	width := 1
+	for len(*tokens) > 0 && (*tokens)[0].value != "end" {
+		token := (*tokens)[0]
+		*tokens = (*tokens)[1:]
+
+		switch {
+		case token.kind == tokenKindStringLit:
+			str, err := stringLitValue(token.value)
+			if err != nil {
+				panic(fmt.Sprintf("%s: invalid string literal in data block", token.location))
+			}
+			out = append(out, str...)
+		case token.value == "db":
+			width = 1
+		case token.value == "dw":
+			width = 2
+		case token.value == "dd":
+			width = 4
+		case token.value == "dq":
+			width = 8
+		default:
+			value := p.evalConstToken(token)
+			// a value fits when it's a signed or an unsigned number of
+			// width bytes
+			if bits := uint(width * 8); bits < 64 && (value < -(1<<(bits-1)) || value >= 1<<bits) {
+				panic(fmt.Sprintf("%s: %s doesn't fit in %d bytes", token.location, p.describeConst(token, value), width))
+			}
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], uint64(value))
+			out = append(out, buf[:width]...)
+		}
+	}
+	if len(*tokens) == 0 {
+		panic("data block used whitout an end")
+	}
+	*tokens = (*tokens)[1:]
+	return out
+}
+
+// lookupFieldAccessor checks if word is a struct field accessor in the
+// form 'Struct.field@' (load) or 'Struct.field!' (store).
+func (p parser) lookupFieldAccessor(tok token) (field structField, isLoad bool, ok bool) {
+	word := tok.value
+	if len(word) < 2 {
+		return field, false, false
+	}
+	switch word[len(word)-1] {
+	case '@':
+		isLoad = true
+	case '!':
+		isLoad = false
+	default:
+		return field, false, false
+	}
+	tok.value = word[:len(word)-1]
+	field, ok = p.fieldStack[p.resolve(tok)]
+	return field, isLoad, ok
+}
+
+// fieldAccessor returns the instructions that add the field offset to the
+// pointer on top of the stack and load or store the field.
+func (p *parser) fieldAccessor(field structField, isLoad bool, tok token) (out []Instruction) {
+	var intrinsic Intrinsic
+	switch {
+	case field.nested:
+		panic(fmt.Sprintf("%s: field '%s' is a struct, it has no accessor, add its offset to the pointer", tok.location, tok.value[:len(tok.value)-1]))
+	case field.size == 1 && isLoad:
+		intrinsic = IntrinsicLoad8
+	case field.size == 1:
+		intrinsic = IntrinsicStore8
+	case field.size == 4 && isLoad:
+		intrinsic = IntrinsicLoad32
+	case field.size == 4:
+		intrinsic = IntrinsicStore32
+	case field.size == 8 && isLoad:
+		intrinsic = IntrinsicLoad64
+	case field.size == 8:
+		intrinsic = IntrinsicStore64
+	default:
+		panic(fmt.Sprintf("%s: field '%s' of size %d has no accessor", tok.location, tok.value, field.size))
+	}
+
+	out = append(out, Instruction{
+		Kind:     InstKindPushInt,
+		ValueInt: field.offset,
+		token:    tok,
+	})
+	out = append(out, Instruction{
+		Kind:           InstKindIntrinsic,
+		ValueIntrinsic: IntrinsicPlus,
+		token:          tok,
+	})
+	out = append(out, Instruction{
+		Kind:           InstKindIntrinsic,
+		ValueIntrinsic: intrinsic,
+		token:          tok,
+	})
+	p.ip += len(out)
+	return out
+}
+
+// callMain appends a call to the function 'main' when it's defined, the
+// second value is false if there is no main.
+func (p *parser) callMain(program Program) (Program, bool) {
+	addr, ok := p.funStack["main"]
+	if !ok {
+		return program, false
+	}
+	program = append(program, Instruction{
+		Kind:       InstKindFunCall,
+		JmpAddress: addr,
+		token:      program[addr].token,
+	})
+	p.ip++
+	return program, true
+}
+
+// defineConsts adds the given consts before parsing the program.
+func (p *parser) defineConsts(consts map[string]int) {
+	if p.constStack == nil {
+		p.constStack = make(map[string]int)
+	}
+	for name, value := range consts {
+		if p.isDefined(name) {
+			panic(fmt.Sprintf("name '%s' already used", name))
+		}
+		p.constStack[name] = value
+	}
+}
+
+// checkNameRedefinition checks that name, defined by tok, is not used
+// yet. The error shows the name as it's written in tok.
+func (p parser) checkNameRedefinition(name string, tok token) {
+	if p.isDefined(name) {
+		panic(fmt.Sprintf("%s: name '%s' already used", tok.location, tok.value))
+	}
+}
+
+func (p parser) isDefined(name string) bool {
 	_, isFun := p.funStack[name]
 	_, isMem := p.memoryStack[name]
 	_, isConst := p.constStack[name]
-	if isFun || isMem || isConst {
-		panic("name already used")
+	_, isStruct := p.structStack[name]
+	_, isEnum := p.enumStack[name]
+	_, isData := p.dataStack[name]
+	_, isMacro := p.macroStack[name]
+	return isFun || isMem || isConst || isStruct || isEnum || isData || isMacro
+}
+
+// qualify returns the name under which the word in tok is defined: it is
+// prefixed by the current namespace and, for private definitions, by the
+// file that contains it so that other files can't see it.
+func (p parser) qualify(tok token) string {
+	name := p.namespace + tok.value
+	if p.privateNextDef {
+		name = privatePrefix(tok.location.fileName) + name
+	}
+	return name
+}
+
+// parseInclude parses the file at path defining its names in namespace.
+func (p *parser) parseInclude(program Program, path string, namespace string) Program {
+	if p.includeLevel+1 > maxIncludeLevel {
+		panic("max include lever reached")
+	}
+	p.includeLevel++
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	tokens := tokenizeSource(string(source), path)
+	outerNamespace := p.namespace
+	p.namespace = namespace
+	program = p.parseProgramFromTokens(program, tokens)
+	p.namespace = outerNamespace
+	p.includeLevel--
+	return program
+}
+
+// publicNames returns the names defined in namespace that are not
+// private, sorted.
+func (p parser) publicNames(namespace string) []string {
+	found := make(map[string]bool)
+	add := func(name string) {
+		if strings.HasPrefix(name, namespace) {
+			found[name] = true
+		}
+	}
+	for name := range p.funStack {
+		add(name)
+	}
+	for name := range p.memoryStack {
+		add(name)
+	}
+	for name := range p.constStack {
+		add(name)
+	}
+	for name := range p.structStack {
+		add(name)
+	}
+	for name := range p.enumStack {
+		add(name)
+	}
+	for name := range p.dataStack {
+		add(name)
+	}
+	for name := range p.macroStack {
+		add(name)
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// importName makes the definition name visible as alias.
+func (p parser) importName(alias string, name string) {
+	for _, imported := range p.imports[alias] {
+		if imported == name {
+			return
+		}
+	}
+	p.imports[alias] = append(p.imports[alias], name)
+}
+
+// moduleOf returns the module defining name.
+func (p parser) moduleOf(name string) *module {
+	for _, mod := range p.modules {
+		if strings.HasPrefix(name, mod.namespace) {
+			return mod
+		}
+	}
+	panic(fmt.Sprintf("'%s' is not defined by an included file", name))
+}
+
+// define qualifies the name in tok and checks that it is not used yet.
+func (p parser) define(tok token) string {
+	name := p.qualify(tok)
+	p.checkNameRedefinition(name, tok)
+	return name
+}
+
+// resolve returns the name of the definition the word in tok refers to,
+// looking first at the private definitions of its file, then at the
+// current namespace and last at the names imported by the includes.
+func (p parser) resolve(tok token) string {
+	if strings.HasPrefix(tok.value, "sizeof(") && strings.HasSuffix(tok.value, ")") {
+		// the size of a struct is named after the struct
+		tok.value = tok.value[len("sizeof(") : len(tok.value)-1]
+		return fmt.Sprintf("sizeof(%s)", p.resolve(tok))
+	}
+	candidates := []string{
+		privatePrefix(tok.location.fileName) + p.namespace + tok.value,
+		p.namespace + tok.value,
+	}
+	if mod, ok := p.modules[moduleKey(tok.location.fileName)]; ok {
+		// the body of a macro sees the names of the file defining it
+		candidates = append(candidates, privatePrefix(tok.location.fileName)+mod.namespace+tok.value, mod.namespace+tok.value)
+	}
+	for _, name := range candidates {
+		if p.isDefined(name) {
+			return name
+		}
+	}
+
+	imported := p.imports[p.namespace+tok.value]
+	if len(imported) > 1 {
+		panic(fmt.Sprintf("%s: '%s' is ambiguous, it's defined in '%s' and '%s', include one of the files with 'as'",
+			tok.location, tok.value, p.moduleOf(imported[0]).path, p.moduleOf(imported[1]).path))
+	}
+	if len(imported) == 1 {
+		return imported[0]
+	}
+	return tok.value
+}
+
+func privatePrefix(fileName string) string {
+	return moduleKey(fileName) + "#"
+}
+
+// modulePrefix is the namespace of an included file.
+func modulePrefix(fileName string) string {
+	return moduleKey(fileName) + ":"
+}
+
+// moduleKey returns the same key for every path naming the file, like
+// "test/std.tin" and "./test/std.tin".
+func moduleKey(fileName string) string {
+	if abs, err := filepath.Abs(fileName); err == nil {
+		return abs
+	}
+	return filepath.Clean(fileName)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
 	}
+	return 0
 }
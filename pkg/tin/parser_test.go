@@ -0,0 +1,87 @@
+package tin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parseError returns the error of the compiler loading source, empty
+// when it's loaded.
+func parseError(t *testing.T, path string, source string) (err string) {
+	if e := ioutil.WriteFile(path, []byte(source), 0644); e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Sprint(r)
+		}
+	}()
+	loadProgram(CompilerOption{InputPath: path, Diagnostics: ioutil.Discard}, TargetSimulator)
+	return ""
+}
+
+func TestParserErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		// the error after the path of the program
+		want string
+	}{
+		{"enum Op A B end\n1 match case A 1 print case A 2 print end\n",
+			":2:24: duplicate case 'A' (0 of enum 'Op') in 'match'"},
+		{"1 match case 1 1 print case 1 2 print end\n",
+			":1:24: duplicate case 1 in 'match'"},
+		{"enum Op A B end\n0 10 for step A i print end\n",
+			":2:15: the step of a 'for' must be positive, it's 'A' (0 of enum 'Op')"},
+		{"const N 0 end\n0 10 for step N i print end\n",
+			":2:15: the step of a 'for' must be positive, it's 'N' (0)"},
+		{"struct Point x 8 y 3 end\n",
+			":1:18: field 'Point.y' has size 3, it must be 1, 4, 8 or the size of a struct"},
+		{"struct Point x 8 y 0 end\n",
+			":1:18: field 'Point.y' must have a positive size"},
+		{"struct Point x 8 y 8 end\nstruct Line a sizeof(Point) b sizeof(Point) end\nmemory l sizeof(Line) end\nl Line.b@\n",
+			":4:3: field 'Line.b' is a struct, it has no accessor, add its offset to the pointer"},
+		{"data d dw 65535 65536 end\n",
+			":1:17: 65536 doesn't fit in 2 bytes"},
+		{"const Big 4294967296 end\ndata d dd 1 Big end\n",
+			":2:13: 'Big' (4294967296) doesn't fit in 4 bytes"},
+		{"data d 255 dw 256 dq 18446744073709551615 end\n",
+			""},
+		{"const i 7 end\n0 3 for i print end\n",
+			":2:9: 'i' is both the counter of the 'for' and a name defined by the program, rename the definition"},
+		{"def i 7 end\n0 3 for i print end\n",
+			":2:9: 'i' is both the counter of the 'for' and a name defined by the program, rename the definition"},
+		{"const i 7 end\ni print\n",
+			""},
+		{"const X 1 end\nconst X 2 end\n",
+			":2:7: name 'X' already used"},
+	}
+
+	dir := t.TempDir()
+	for i, test := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("program%d.tin", i))
+		want := ""
+		if test.want != "" {
+			want = path + test.want
+		}
+		if err := parseError(t, path, test.source); err != want {
+			t.Errorf("program %d: the error is %q, want %q", i, strings.TrimPrefix(err, path), test.want)
+		}
+	}
+}
+
+// the errors in an included file show the names as they are written, not
+// with the namespace of the file
+func TestParserErrorsInclude(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib.tin")
+	if err := ioutil.WriteFile(lib, []byte("const X 1 end\nconst X 2 end\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := lib + ":2:7: name 'X' already used"
+	if err := parseError(t, filepath.Join(dir, "main.tin"), fmt.Sprintf("include %q as lib\n", lib)); err != want {
+		t.Errorf("the error is %q, want %q", err, want)
+	}
+}
@@ -0,0 +1,492 @@
+package tin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	// the simulated memory starts after a small gap so that 0 is never a
+	// valid address
+	simMemoryBase int = 8
+
+	syscallWrite     int = 1
+	syscallExit      int = 60
+	syscallExitGroup int = 231
+)
+
+type simulator struct {
+	program  Program
+	ip       int
+	stack    []int
+	retStack []int
+	// counter and limit of the innermost 'for'
+	counter int
+	limit   int
+	// the memory holds the 'memory' blocks followed by the strings and
+	// data blocks that are added the first time they are used
+	memory  []byte
+	strings map[int]int
+	data    map[string]int
+	stdout  io.Writer
+	stderr  io.Writer
+	// capacity of the return stack in number of values
+	retCapacity int
+	// output written with 'bwrite' and 'printn' waiting to be flushed
+	outBuf []byte
+	outTTY bool
+	// first block of the list of the free blocks of the heap
+	freeList   int
+	stackCheck StackCheck
+	exited     bool
+	exit       int
+}
+
+// simulateProgram executes the program writing its output to stdout and
+// stderr, it returns the exit code of the program.
+func simulateProgram(program Program, option CompilerOption, stdout io.Writer, stderr io.Writer) int {
+	sim := simulator{
+		program: program,
+		// the memories are sized like the mem block of the runtime
+		memory:  make([]byte, simMemoryBase+memorySize(program)),
+		strings: make(map[int]int),
+		data:    make(map[string]int),
+		stdout:  stdout,
+		stderr:  stderr,
+		// every value takes 8 bytes in the runtime
+		retCapacity: option.returnStackSize() / 8,
+		stackCheck:  option.StackCheck,
+	}
+	if f, ok := stdout.(*os.File); ok {
+		info, err := f.Stat()
+		sim.outTTY = err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+	for sim.ip < len(program) && !sim.exited {
+		sim.step()
+	}
+	if !sim.exited {
+		sim.flushOutput()
+		if len(program) > 0 {
+			sim.checkStack(program[len(program)-1])
+		}
+	}
+	return sim.exit
+}
+
+func (sim *simulator) step() {
+	inst := sim.program[sim.ip]
+	switch inst.Kind {
+	case InstKindPushInt:
+		sim.push(inst.ValueInt)
+		sim.ip++
+	case InstKindPushString:
+		str, err := stringLitValue(inst.ValueString)
+		if err != nil {
+			panic(fmt.Sprintf("%s: invalid string literal", inst.token.location))
+		}
+		addr, ok := sim.strings[sim.ip]
+		if !ok {
+			addr = sim.alloc([]byte(str))
+			sim.strings[sim.ip] = addr
+		}
+		sim.push(len(str))
+		sim.push(addr)
+		sim.ip++
+	case InstKindIntrinsic:
+		sim.intrinsic(inst)
+		sim.ip++
+	case InstKindTestCondition:
+		if sim.pop(inst) == 0 {
+			sim.ip = inst.JmpAddress
+		} else {
+			sim.ip++
+		}
+	case InstKindElse, InstKindElif, InstKindCase, InstKindEnd, InstKindJump,
+		InstKindBreak, InstKindContinue, InstKindFunSkip:
+		sim.ip = inst.JmpAddress
+	case InstKindMatch:
+		value := sim.pop(inst)
+		sim.ip = inst.JmpAddress
+		for _, c := range inst.ValueCases {
+			if c.Value == value {
+				sim.ip = c.Address
+				break
+			}
+		}
+	case InstKindWhile:
+		sim.ip++
+	case InstKindForStart:
+		if !sim.pushRet(inst, sim.counter, sim.limit) {
+			return
+		}
+		if inst.ValueInt > 0 {
+			sim.limit = sim.pop(inst)
+			sim.counter = sim.pop(inst)
+		} else {
+			sim.counter = sim.pop(inst) - 1
+			sim.limit = sim.pop(inst)
+		}
+		sim.ip++
+	case InstKindForTest:
+		if (inst.ValueInt > 0 && sim.counter >= sim.limit) || (inst.ValueInt <= 0 && sim.counter < sim.limit) {
+			sim.ip = inst.JmpAddress
+		} else {
+			sim.ip++
+		}
+	case InstKindForNext:
+		sim.counter += inst.ValueInt
+		sim.ip = inst.JmpAddress
+	case InstKindForEnd:
+		sim.limit = sim.popRet(inst)
+		sim.counter = sim.popRet(inst)
+		sim.ip++
+	case InstKindForIndex:
+		sim.push(sim.counter)
+		sim.ip++
+	case InstKindFunDef:
+		sim.ip++
+	case InstKindFunRet:
+		sim.ip = sim.popRet(inst)
+	case InstKindFunCall:
+		// a tail call leaves the callee return to our caller
+		if !inst.TailCall && !sim.pushRet(sim.program[inst.JmpAddress], sim.ip+1) {
+			return
+		}
+		sim.ip = inst.JmpAddress
+	case InstKindFunAddr:
+		sim.push(inst.JmpAddress)
+		sim.ip++
+	case InstKindFunCast:
+		sim.ip++
+	case InstKindMemPush:
+		sim.push(simMemoryBase + inst.ValueMemory)
+		sim.ip++
+	case InstKindDataPush:
+		addr, ok := sim.data[inst.ValueData.Name]
+		if !ok {
+			addr = sim.alloc(inst.ValueData.Bytes)
+			sim.data[inst.ValueData.Name] = addr
+		}
+		sim.push(addr)
+		sim.ip++
+	case InstKindAssert:
+		ptr := sim.pop(inst)
+		length := sim.pop(inst)
+		if sim.pop(inst) == 0 {
+			sim.flushOutput()
+			fmt.Fprintf(sim.stderr, "%s: assertion failed: ", inst.token.location)
+			sim.stderr.Write(sim.slice(inst, ptr, length))
+			fmt.Fprintln(sim.stderr)
+			sim.exited = true
+			sim.exit = 1
+		}
+		sim.ip++
+	case InstKindDrop:
+		for i := 0; i < inst.ValueInt; i++ {
+			sim.pop(inst)
+		}
+		sim.ip++
+	default:
+		panic(fmt.Sprintf("unknown instruction kind '%s'", inst.Kind))
+	}
+}
+
+func (sim *simulator) intrinsic(inst Instruction) {
+	switch inst.ValueIntrinsic {
+	case IntrinsicPlus:
+		b, a := sim.pop(inst), sim.pop(inst)
+		sim.push(a + b)
+	case IntrinsicMinus:
+		b, a := sim.pop(inst), sim.pop(inst)
+		sim.push(a - b)
+	case IntrinsicTimes:
+		b, a := sim.pop(inst), sim.pop(inst)
+		sim.push(a * b)
+	case IntrinsicDivMod:
+		b, a := sim.pop(inst), sim.pop(inst)
+		if b == 0 {
+			panic(fmt.Sprintf("%s: division by zero", inst.token.location))
+		}
+		sim.push(a / b)
+		sim.push(a % b)
+	case IntrinsicGreather:
+		b, a := sim.pop(inst), sim.pop(inst)
+		sim.push(boolToInt(a > b))
+	case IntrinsicLess:
+		b, a := sim.pop(inst), sim.pop(inst)
+		sim.push(boolToInt(a < b))
+	case IntrinsicNotEqual:
+		b, a := sim.pop(inst), sim.pop(inst)
+		sim.push(boolToInt(a != b))
+	case IntrinsicDup:
+		a := sim.pop(inst)
+		sim.push(a)
+		sim.push(a)
+	case IntrinsicPrint:
+		sim.bufferedWrite([]byte(formatNumber(sim.pop(inst), 10|printNewline)))
+	case IntrinsicPrintNumber:
+		format := sim.pop(inst)
+		if format&printStderr != 0 {
+			sim.flushOutput()
+			io.WriteString(sim.stderr, formatNumber(sim.pop(inst), format))
+		} else {
+			sim.bufferedWrite([]byte(formatNumber(sim.pop(inst), format)))
+		}
+	case IntrinsicBufferedWrite:
+		ptr, length := sim.pop(inst), sim.pop(inst)
+		sim.bufferedWrite(sim.slice(inst, ptr, length))
+	case IntrinsicFlush:
+		sim.flushOutput()
+	case IntrinsicAlloc:
+		sim.push(sim.heapAlloc(sim.pop(inst)))
+	case IntrinsicFree:
+		sim.heapFree(inst, sim.pop(inst))
+	case IntrinsicRealloc:
+		size, ptr := sim.pop(inst), sim.pop(inst)
+		sim.push(sim.heapRealloc(inst, ptr, size))
+	case IntrinsicCall:
+		addr := sim.pop(inst)
+		if !inst.TailCall && !sim.pushRet(sim.program[addr], sim.ip+1) {
+			return
+		}
+		// the caller increments ip after the intrinsic
+		sim.ip = addr - 1
+	case IntrinsicExit:
+		sim.flushOutput()
+		sim.exited = true
+		sim.exit = sim.pop(inst)
+		sim.checkStack(inst)
+	case IntrinsicSyscall0, IntrinsicSyscall1, IntrinsicSyscall2, IntrinsicSyscall3,
+		IntrinsicSyscall4, IntrinsicSyscall5, IntrinsicSyscall6:
+		number := sim.pop(inst)
+		args := make([]int, int(inst.ValueIntrinsic-IntrinsicSyscall0))
+		for i := range args {
+			args[i] = sim.pop(inst)
+		}
+		sim.syscall(inst, number, args)
+	case IntrinsicLoad8:
+		sim.push(int(sim.slice(inst, sim.pop(inst), 1)[0]))
+	case IntrinsicStore8:
+		addr, value := sim.pop(inst), sim.pop(inst)
+		sim.slice(inst, addr, 1)[0] = byte(value)
+	case IntrinsicLoad32:
+		sim.push(int(binary.LittleEndian.Uint32(sim.slice(inst, sim.pop(inst), 4))))
+	case IntrinsicStore32:
+		addr, value := sim.pop(inst), sim.pop(inst)
+		binary.LittleEndian.PutUint32(sim.slice(inst, addr, 4), uint32(value))
+	case IntrinsicLoad64:
+		sim.push(int(binary.LittleEndian.Uint64(sim.slice(inst, sim.pop(inst), 8))))
+	case IntrinsicStore64:
+		addr, value := sim.pop(inst), sim.pop(inst)
+		binary.LittleEndian.PutUint64(sim.slice(inst, addr, 8), uint64(value))
+	default:
+		panic(fmt.Sprintf("unknown intrinsic '%s'", inst.ValueIntrinsic))
+	}
+}
+
+// checkStack warns when the program ending at inst leaves values on the
+// data stack and the check is done at runtime.
+func (sim *simulator) checkStack(inst Instruction) {
+	if sim.stackCheck == StackCheckRuntime && len(sim.stack) > 0 {
+		fmt.Fprintln(sim.stderr, leftoverStackWarning(inst.token.location))
+	}
+}
+
+// formatNumber formats value like the 'print_number' routine of the
+// runtime, an invalid base is replaced by 10.
+func formatNumber(value int, format int) (out string) {
+	base := format & printBaseMask
+	if base < 2 || base > 16 {
+		base = 10
+	}
+	if format&printSigned != 0 && value < 0 {
+		out = "-" + strconv.FormatUint(-uint64(value), base)
+	} else {
+		out = strconv.FormatUint(uint64(value), base)
+	}
+	if format&printNewline != 0 {
+		out += "\n"
+	}
+	return out
+}
+
+// syscall executes the few system calls supported by the simulator.
+func (sim *simulator) syscall(inst Instruction, number int, args []int) {
+	switch {
+	case number == syscallWrite && len(args) >= 3:
+		out := sim.stdout
+		switch args[0] {
+		case 1:
+		case 2:
+			out = sim.stderr
+		default:
+			panic(fmt.Sprintf("%s: the simulator can't write to the file descriptor %d", inst.token.location, args[0]))
+		}
+		out.Write(sim.slice(inst, args[1], args[2]))
+	case number == syscallExit && len(args) >= 1:
+		// like the runtime the output is flushed before every exit
+		sim.flushOutput()
+		sim.exited = true
+		sim.exit = args[0]
+	default:
+		panic(fmt.Sprintf("%s: syscall %d is not supported by the simulator", inst.token.location, number))
+	}
+}
+
+// bufferedWrite appends bytes to the output buffer like the
+// 'buffered_write' routine of the runtime.
+func (sim *simulator) bufferedWrite(buf []byte) {
+	if len(sim.outBuf)+len(buf) > outputBufferSize {
+		sim.flushOutput()
+		if len(buf) > outputBufferSize {
+			sim.stdout.Write(buf)
+			return
+		}
+	}
+	sim.outBuf = append(sim.outBuf, buf...)
+	if sim.outTTY && bytes.IndexByte(buf, '\n') >= 0 {
+		sim.flushOutput()
+	}
+}
+
+func (sim *simulator) flushOutput() {
+	if len(sim.outBuf) > 0 {
+		sim.stdout.Write(sim.outBuf)
+		sim.outBuf = sim.outBuf[:0]
+	}
+}
+
+// heapAlloc returns a block of size bytes like the 'heap_alloc' routine
+// of the runtime, new blocks are added at the end of the memory.
+func (sim *simulator) heapAlloc(size int) int {
+	if size < 0 {
+		// too big, like the mmap of the runtime would fail
+		return 0
+	}
+	size = (size + heapHeaderSize - 1) &^ (heapHeaderSize - 1)
+	if size <= 0 {
+		size = heapHeaderSize
+	}
+	if size < heapMmapThreshold {
+		// first fit in the free list
+		link := 0
+		for block := sim.freeList; block != 0; block = sim.load64(block + 8) {
+			if sim.load64(block) >= size {
+				if link == 0 {
+					sim.freeList = sim.load64(block + 8)
+				} else {
+					sim.store64(link, sim.load64(block+8))
+				}
+				return block + heapHeaderSize
+			}
+			link = block + 8
+		}
+	}
+
+	block := sim.alloc(make([]byte, heapHeaderSize+size))
+	if size >= heapMmapThreshold {
+		sim.store64(block, size|1)
+	} else {
+		sim.store64(block, size)
+	}
+	return block + heapHeaderSize
+}
+
+func (sim *simulator) heapFree(inst Instruction, ptr int) {
+	if ptr == 0 {
+		return
+	}
+	block := ptr - heapHeaderSize
+	if sim.load64(sim.checkBlock(inst, block))&1 != 0 {
+		// mapped blocks are given back to the system, the simulator just
+		// leaves them alone
+		return
+	}
+	sim.store64(block+8, sim.freeList)
+	sim.freeList = block
+}
+
+func (sim *simulator) heapRealloc(inst Instruction, ptr int, size int) int {
+	if ptr == 0 {
+		return sim.heapAlloc(size)
+	}
+	capacity := sim.load64(sim.checkBlock(inst, ptr-heapHeaderSize)) &^ 1
+	if size <= capacity {
+		return ptr
+	}
+	newPtr := sim.heapAlloc(size)
+	copy(sim.memory[newPtr:], sim.memory[ptr:ptr+capacity])
+	sim.heapFree(inst, ptr)
+	return newPtr
+}
+
+func (sim *simulator) checkBlock(inst Instruction, block int) int {
+	if block < simMemoryBase || block+heapHeaderSize > len(sim.memory) {
+		panic(fmt.Sprintf("%s: %d is not a block of the heap", inst.token.location, block+heapHeaderSize))
+	}
+	return block
+}
+
+func (sim *simulator) load64(addr int) int {
+	return int(binary.LittleEndian.Uint64(sim.memory[addr:]))
+}
+
+func (sim *simulator) store64(addr int, value int) {
+	binary.LittleEndian.PutUint64(sim.memory[addr:], uint64(value))
+}
+
+func (sim *simulator) push(value int) {
+	sim.stack = append(sim.stack, value)
+}
+
+func (sim *simulator) pop(inst Instruction) int {
+	if len(sim.stack) == 0 {
+		panic(fmt.Sprintf("%s: stack underflow", inst.token.location))
+	}
+	value := sim.stack[len(sim.stack)-1]
+	sim.stack = sim.stack[:len(sim.stack)-1]
+	return value
+}
+
+// pushRet pushes values to the return stack on behalf of inst, when the
+// return stack is full it aborts the program like the runtime does and
+// returns false.
+func (sim *simulator) pushRet(inst Instruction, values ...int) bool {
+	if len(sim.retStack)+len(values) > sim.retCapacity {
+		sim.flushOutput()
+		fmt.Fprintln(sim.stderr, returnStackOverflowMessage(inst))
+		sim.exited = true
+		sim.exit = 1
+		return false
+	}
+	sim.retStack = append(sim.retStack, values...)
+	return true
+}
+
+func (sim *simulator) popRet(inst Instruction) int {
+	if len(sim.retStack) == 0 {
+		panic(fmt.Sprintf("%s: return stack underflow", inst.token.location))
+	}
+	value := sim.retStack[len(sim.retStack)-1]
+	sim.retStack = sim.retStack[:len(sim.retStack)-1]
+	return value
+}
+
+// alloc copies bytes at the end of the memory and returns their address.
+func (sim *simulator) alloc(bytes []byte) int {
+	addr := len(sim.memory)
+	sim.memory = append(sim.memory, bytes...)
+	return addr
+}
+
+// slice returns the size bytes of memory starting at addr.
+func (sim *simulator) slice(inst Instruction, addr int, size int) []byte {
+	if addr < simMemoryBase || size < 0 || addr+size > len(sim.memory) {
+		panic(fmt.Sprintf("%s: invalid memory access of %d bytes at %d", inst.token.location, size, addr))
+	}
+	return sim.memory[addr : addr+size]
+}
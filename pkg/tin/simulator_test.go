@@ -0,0 +1,193 @@
+package tin
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testPrograms are the exit codes of the programs in test/, what they
+// write to stdout is in test/expected/<name>.out
+var testPrograms = map[string]int{
+	"123":                0,
+	"arithmetics":        0,
+	"assert":             1,
+	"bench_calls":        0,
+	"break":              0,
+	"buffer":             0,
+	"const":              0,
+	"counter":            0,
+	"data":               0,
+	"elif":               0,
+	"enum":               0,
+	"exit":               49,
+	"exit_syscall":       3,
+	"for":                0,
+	"func":               0,
+	"funptr":             0,
+	"heap":               0,
+	"if":                 0,
+	"if_else":            0,
+	"inc":                0,
+	"inline":             0,
+	"macro":              0,
+	"match":              0,
+	"memory":             0,
+	"memory_large":       0,
+	"module":             0,
+	"namespace":          0,
+	"optimize":           0,
+	"peephole":           0,
+	"print":              0,
+	"recursion":          0,
+	"recursion_overflow": 1,
+	"registers":          0,
+	"static_if":          0,
+	"std":                0,
+	"strength_reduction": 0,
+	"string":             0,
+	"struct":             0,
+	"tail_call":          0,
+	"unused":             0,
+	"while":              0,
+}
+
+// the benchmarks take seconds in the simulator, 'go test -short' skips
+// them
+var slowTestPrograms = map[string]bool{
+	"bench_calls": true,
+	"tail_call":   true,
+}
+
+// testProgramNames returns the names of the programs in testPrograms,
+// sorted.
+func testProgramNames() []string {
+	names := make([]string, 0, len(testPrograms))
+	for name := range testPrograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// simulate runs program in the simulator, it returns what the program
+// writes to stdout and stderr and its exit code.
+func simulate(option CompilerOption, program Program) (stdout string, stderr string, exitCode int) {
+	var out, errOut bytes.Buffer
+	exitCode = simulateProgram(program, option, &out, &errOut)
+	return out.String(), errOut.String(), exitCode
+}
+
+// load is loadProgram reporting the errors of the compiler as failures.
+func load(t *testing.T, option CompilerOption, target Target) (program Program) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("%s: %s", option.InputPath, r)
+		}
+	}()
+	return loadProgram(option, target)
+}
+
+// TestSimulatorPrograms runs every program in test/ with and without the
+// optimizations, checking what it writes to stdout and its exit code.
+func TestSimulatorPrograms(t *testing.T) {
+	chdirRoot(t)
+	paths, err := filepath.Glob("test/*.tin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		if _, ok := testPrograms[strings.TrimSuffix(filepath.Base(path), ".tin")]; !ok {
+			t.Errorf("%s: not in testPrograms", path)
+		}
+	}
+
+	for _, name := range testProgramNames() {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			if testing.Short() && slowTestPrograms[name] {
+				t.Skip("slow in the simulator")
+			}
+			t.Parallel()
+			expected := filepath.Join("test", "expected", name+".out")
+			for _, level := range []int{0, 1} {
+				option := CompilerOption{
+					InputPath:         filepath.Join("test", name+".tin"),
+					OptimizationLevel: level,
+					StackCheck:        StackCheckOff,
+				}
+				stdout, _, exitCode := simulate(option, load(t, option, TargetSimulator))
+				if exitCode != testPrograms[name] {
+					t.Errorf("exit code %d with -O%d, want %d", exitCode, level, testPrograms[name])
+				}
+				if *update && level == 0 {
+					if err := ioutil.WriteFile(expected, []byte(stdout), 0644); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				want, err := ioutil.ReadFile(expected)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stdout != string(want) {
+					t.Errorf("the output with -O%d differs from %s", level, expected)
+				}
+			}
+		})
+	}
+}
+
+// TestStackCheckRuntime checks the warning about the values left on the
+// data stack when the program ends, at its end or through exit.
+func TestStackCheckRuntime(t *testing.T) {
+	tests := []struct {
+		source   string
+		exitCode int
+		// location of the warning, empty when there is none
+		warning string
+	}{
+		{"1 2 print\n", 0, "1:5"},
+		{"1 print\n", 0, ""},
+		{"def main 7 42 end\n", 42, "1:1"},
+		{"def main 42 end\n", 42, ""},
+		{"1 2 3 exit\n", 3, "1:7"},
+		{"def fail 0 > if 3 exit end end\n1 2 1 fail\n", 3, "1:19"},
+	}
+
+	dir := t.TempDir()
+	for i, test := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("program%d.tin", i))
+		if err := ioutil.WriteFile(path, []byte(test.source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want := ""
+		if test.warning != "" {
+			want = fmt.Sprintf("%s:%s: warning: values left on the data stack at the end of the program\n", path, test.warning)
+		}
+
+		var diagnostics bytes.Buffer
+		option := CompilerOption{InputPath: path, StackCheck: StackCheckRuntime, Diagnostics: &diagnostics}
+		_, stderr, exitCode := simulate(option, load(t, option, TargetSimulator))
+		if stderr != want || exitCode != test.exitCode {
+			t.Errorf("program %d: the simulator wrote %q and exited with %d, want %q and %d", i, stderr, exitCode, want, test.exitCode)
+		}
+		// the compiler warns with the same message, at the end of the
+		// program
+		if diagnostics.Len() > 0 && !strings.HasSuffix(diagnostics.String(), ": warning: values left on the data stack at the end of the program\n") {
+			t.Errorf("program %d: the compiler wrote %q", i, diagnostics.String())
+		}
+
+		if _, err := exec.LookPath("nasm"); err == nil {
+			_, stderr, exitCode := runX8664(t, option, filepath.Join(dir, fmt.Sprintf("program%d", i)))
+			if stderr != want || exitCode != test.exitCode {
+				t.Errorf("program %d: the binary wrote %q and exited with %d, want %q and %d", i, stderr, exitCode, want, test.exitCode)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package tin
+
+import "fmt"
+
+// staticBranch is a branch of a 'static if': the tokens of its condition
+// and the tokens of its body.
+type staticBranch struct {
+	cond   []token
+	body   []token
+	isElse bool
+}
+
+// splitStaticIf splits a 'static if cond do body elif cond do body else
+// body end' in its branches, tokens starts after the 'if'. It returns the
+// branches and the tokens that follow the final 'end'.
+func splitStaticIf(tokens []token, location fileLocation) (branches []staticBranch, rest []token) {
+	var branch staticBranch
+	inCond := true
+	level := 0
+	for {
+		if len(tokens) == 0 {
+			panic(fmt.Sprintf("%s: 'static if' used whitout an end", location))
+		}
+		t := tokens[0]
+		tokens = tokens[1:]
+
+		if inCond {
+			if t.kind == tokenKindKeyword && t.value == "do" {
+				inCond = false
+				continue
+			}
+			branch.cond = append(branch.cond, t)
+			continue
+		}
+
+		if t.kind == tokenKindKeyword {
+			switch {
+			case level == 0 && t.value == "end":
+				return append(branches, branch), tokens
+			case level == 0 && t.value == "elif":
+				if branch.isElse {
+					panic(fmt.Sprintf("%s: 'static if' with an elif after the else", t.location))
+				}
+				branches = append(branches, branch)
+				branch = staticBranch{}
+				inCond = true
+				continue
+			case level == 0 && t.value == "else":
+				if branch.isElse {
+					panic(fmt.Sprintf("%s: 'static if' with more than one else", t.location))
+				}
+				branches = append(branches, branch)
+				branch = staticBranch{isElse: true}
+				continue
+			case t.value == "end":
+				level--
+			case blockKeywords[t.value]:
+				level++
+			}
+		}
+		branch.body = append(branch.body, t)
+	}
+}
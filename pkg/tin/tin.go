@@ -2,13 +2,108 @@ package tin
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 )
 
+// Target is the backend a program is compiled for.
+type Target int
+
+const (
+	TargetX8664 Target = iota
+	TargetSimulator
+)
+
+// StackCheck tells how to report the values left on the data stack at
+// the end of the program.
+type StackCheck int
+
+const (
+	// warn at compile time
+	StackCheckWarn StackCheck = iota
+	// don't report them
+	StackCheckOff
+	// warn at compile time and check again when the program ends
+	StackCheckRuntime
+)
+
+// leftoverStackWarning is the warning about the values left on the data
+// stack when the program ends at location, at compile time and at
+// runtime.
+func leftoverStackWarning(location fileLocation) string {
+	return fmt.Sprintf("%s: warning: values left on the data stack at the end of the program", location)
+}
+
 type CompilerOption struct {
-	InputPath  string
-	OutputPath string
+	InputPath         string
+	OutputPath        string
+	OptimizationLevel int
+	// consts defined from the command line
+	Defines map[string]int
+	// runtime asserts are not checked
+	StripAsserts bool
+	StackCheck   StackCheck
+	// size in bytes of the return stack, 0 means the default size
+	ReturnStackSize int
+	// report the unused definitions removed by the optimizations
+	Verbose bool
+	// the warnings and the reports of the compiler are written here, nil
+	// means os.Stderr
+	Diagnostics io.Writer
+}
+
+const defaultReturnStackSize int = 1024
+
+func (option CompilerOption) diagnostics() io.Writer {
+	if option.Diagnostics == nil {
+		return os.Stderr
+	}
+	return option.Diagnostics
+}
+
+func (option CompilerOption) returnStackSize() int {
+	if option.ReturnStackSize <= 0 {
+		return defaultReturnStackSize
+	}
+	return option.ReturnStackSize
+}
+
+// returnStackOverflowMessage is the error reported when inst, a function
+// definition or the start of a 'for', finds the return stack full.
+func returnStackOverflowMessage(inst Instruction) string {
+	if inst.Kind == InstKindFunDef {
+		return fmt.Sprintf("%s: return stack overflow in function '%s'", inst.token.location, inst.ValueString)
+	}
+	return fmt.Sprintf("%s: return stack overflow", inst.token.location)
+}
+
+// the format of the numbers written by 'printn' is a base between 2 and
+// 16 combined with these flags
+const (
+	printBaseMask int = 0xff
+	printSigned   int = 0x100
+	printNewline  int = 0x200
+	printStderr   int = 0x400
+)
+
+// runtimeConsts returns the built-in consts used with the runtime.
+func runtimeConsts() map[string]int {
+	return map[string]int{
+		"PRINT_SIGNED":  printSigned,
+		"PRINT_NEWLINE": printNewline,
+		"PRINT_STDERR":  printStderr,
+	}
+}
+
+// targetConsts returns the built-in consts that describe the target.
+func targetConsts(target Target) map[string]int {
+	return map[string]int{
+		"TARGET":           int(target),
+		"TARGET_X86_64":    int(TargetX8664),
+		"TARGET_SIMULATOR": int(TargetSimulator),
+		"WORD_SIZE":        8,
+	}
 }
 
 func CompileFile(option CompilerOption) (err error) {
@@ -18,20 +113,64 @@ func CompileFile(option CompilerOption) (err error) {
 		}
 	}()
 
+	program := loadProgram(option, TargetX8664)
+	asm := generateNasmX8664(program, option)
+
+	if e := ioutil.WriteFile(option.OutputPath, []byte(asm), os.ModePerm); e != nil {
+		panic(e)
+	}
+
+	return err
+}
+
+// SimulateFile executes the program in the simulator instead of compiling
+// it, it returns the exit code of the program.
+func SimulateFile(option CompilerOption) (exitCode int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s", r)
+		}
+	}()
+
+	program := loadProgram(option, TargetSimulator)
+	return simulateProgram(program, option, os.Stdout, os.Stderr), nil
+}
+
+// loadProgram parses and checks the input file preparing it for target.
+func loadProgram(option CompilerOption, target Target) Program {
 	source, err := ioutil.ReadFile(option.InputPath)
 	if err != nil {
 		panic(err)
 	}
 
 	tokens := tokenizeSource(string(source), option.InputPath)
-	fmt.Println(tokens)
-	parser := parser{}
-	program := parser.parseProgramFromTokens(tokens)
-	asm := generateNasmX8664(program)
-
-	if e := ioutil.WriteFile(option.OutputPath, []byte(asm), os.ModePerm); e != nil {
-		panic(e)
+	parser := parser{stripAsserts: option.StripAsserts}
+	parser.defineConsts(targetConsts(target))
+	parser.defineConsts(runtimeConsts())
+	parser.defineConsts(option.Defines)
+	program := parser.parseProgramFromTokens(nil, tokens)
+	program, hasMain := parser.callMain(program)
+	depth := typeCheckProgram(program)
+	if hasMain && depth > 0 {
+		// the value returned by main is the exit code
+		program = append(program, Instruction{
+			Kind:           InstKindIntrinsic,
+			ValueIntrinsic: IntrinsicExit,
+			token:          program[len(program)-1].token,
+		})
+		depth--
 	}
-
-	return err
+	if depth > 0 && option.StackCheck != StackCheckOff {
+		fmt.Fprintln(option.diagnostics(), leftoverStackWarning(program[len(program)-1].token.location))
+	}
+	program = inlineFunctions(program, option.OptimizationLevel >= 1)
+	if option.OptimizationLevel >= 1 {
+		optimized := optimizeProgram(program)
+		if option.Verbose {
+			reportRemovedDefinitions(option.diagnostics(), program, optimized, parser.memoryStack)
+		}
+		program = compactMemories(optimized)
+	}
+	// recursive loops rely on tail calls, they are done at every level
+	return markTailCalls(program)
 }
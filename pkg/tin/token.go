@@ -3,6 +3,7 @@ package tin
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
 )
@@ -27,7 +28,7 @@ const (
 	commentRegexStr   string = `^#.*`
 	intLitRegexStr    string = `^\d+`
 	stringLitRegexStr string = `^"([^"\\]|\\.)*"`
-	keywordRegexStr   string = `^(if|else|end|while|do|def|include|memory|const)`
+	keywordRegexStr   string = `^(if|elif|else|match|case|end|while|do|for|break|continue|return|inline|private|static_assert|static|def|include|memory|const|struct|enum|data|rodata|embed|macro)\b`
 )
 
 func tokenizeSource(source string, fileName string) (out []token) {
@@ -149,3 +150,9 @@ func (t tokenKind) String() string {
 func (t token) String() string {
 	return fmt.Sprintf("(%s, %s, %s)", t.location, t.kind, t.value)
 }
+
+// stringLitValue returns the content of a string literal with its escape
+// sequences interpreted.
+func stringLitValue(literal string) (string, error) {
+	return strconv.Unquote(`"` + literal + `"`)
+}
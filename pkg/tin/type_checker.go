@@ -0,0 +1,355 @@
+package tin
+
+import "fmt"
+
+// funSignature is the effect of a function on the data stack: the number
+// of values it takes and the number of values it leaves.
+type funSignature struct {
+	ins  int
+	outs int
+}
+
+// stackAnalysis is the result of walking all the paths of a function (or
+// of the main program) keeping track of the stack.
+type stackAnalysis struct {
+	stacks    map[int]stackType
+	minDepth  int
+	exitDepth int
+	hasExit   bool
+}
+
+// stackType is the shape of the stack at some point of a function: its
+// depth relative to the start of the function and the values that are
+// known to be functions.
+type stackType struct {
+	depth int
+	funs  []funSlot
+}
+
+// funSlot is a value on the stack at position pos that is a function with
+// signature sig.
+type funSlot struct {
+	pos int
+	sig funSignature
+}
+
+type typeChecker struct {
+	program    Program
+	signatures map[int]funSignature
+	inProgress map[int]bool
+}
+
+type stackState struct {
+	addr  int
+	stack stackType
+}
+
+// typeCheckProgram checks that every path through the program leaves the
+// stack in a consistent shape: branches that join must have the same stack
+// depth, every exit of a function must leave the same number of values and
+// the main program must never read more values than it pushed.
+// It returns the depth of the stack at the end of the program.
+func typeCheckProgram(program Program) int {
+	tc := typeChecker{
+		program:    program,
+		signatures: make(map[int]funSignature),
+		inProgress: make(map[int]bool),
+	}
+
+	for addr, inst := range program {
+		if inst.Kind == InstKindFunDef {
+			tc.signature(addr)
+		}
+	}
+
+	main := tc.analyze(0, true)
+	return main.exitDepth
+}
+
+// signature returns the signature of the function defined at addr, the
+// second value is false if the function is still being analyzed.
+func (tc *typeChecker) signature(addr int) (funSignature, bool) {
+	if sig, ok := tc.signatures[addr]; ok {
+		return sig, true
+	}
+	if tc.inProgress[addr] {
+		return funSignature{}, false
+	}
+
+	tc.inProgress[addr] = true
+	analysis := tc.analyze(addr, false)
+	delete(tc.inProgress, addr)
+
+	sig := funSignature{
+		ins:  -analysis.minDepth,
+		outs: analysis.exitDepth - analysis.minDepth,
+	}
+	if !analysis.hasExit {
+		// the function never returns, every path ends with an exit
+		sig.outs = 0
+	}
+	tc.signatures[addr] = sig
+	return sig, true
+}
+
+// knownSignature is like signature but fails if the function is still
+// being analyzed.
+func (tc *typeChecker) knownSignature(addr int) funSignature {
+	sig, ok := tc.signature(addr)
+	if !ok {
+		panic(fmt.Sprintf("%s: cannot use a function inside its own definition", tc.locationOf(addr)))
+	}
+	return sig
+}
+
+func (tc *typeChecker) analyze(start int, isMain bool) (out stackAnalysis) {
+	out.stacks = make(map[int]stackType)
+	var work, deferred []stackState
+
+	visit := func(addr int, stack stackType) {
+		if s, ok := out.stacks[addr]; ok {
+			if s.depth != stack.depth {
+				panic(fmt.Sprintf("%s: inconsistent stack, %d values on one path and %d on another", tc.locationOf(addr), s.depth, stack.depth))
+			}
+			if !s.equal(stack) {
+				panic(fmt.Sprintf("%s: inconsistent stack, the functions on the stack differ between paths", tc.locationOf(addr)))
+			}
+			return
+		}
+		out.stacks[addr] = stack
+		work = append(work, stackState{addr: addr, stack: stack})
+	}
+	need := func(addr int, stack stackType, n int) {
+		if stack.depth-n < out.minDepth {
+			if isMain {
+				panic(fmt.Sprintf("%s: stack underflow, expected %d values but found %d", tc.locationOf(addr), n, stack.depth))
+			}
+			out.minDepth = stack.depth - n
+		}
+	}
+	exit := func(addr int, stack stackType) {
+		if out.hasExit && out.exitDepth != stack.depth {
+			panic(fmt.Sprintf("%s: inconsistent stack at exit, %d values here and %d on another exit", tc.locationOf(addr), stack.depth, out.exitDepth))
+		}
+		out.hasExit = true
+		out.exitDepth = stack.depth
+	}
+
+	visit(start, stackType{})
+	for len(work) > 0 || len(deferred) > 0 {
+		if len(work) == 0 {
+			// only recursive calls are left, use what we know from the
+			// exits reached so far as the signature of the function
+			state := deferred[0]
+			deferred = deferred[1:]
+			if !out.hasExit || tc.program[state.addr].JmpAddress != start {
+				panic(fmt.Sprintf("%s: cannot infer the stack effect of a recursive call", tc.locationOf(state.addr)))
+			}
+			need(state.addr, state.stack, -out.minDepth)
+			visit(state.addr+1, state.stack.pop(-out.minDepth).push(out.exitDepth-out.minDepth))
+			continue
+		}
+
+		state := work[len(work)-1]
+		work = work[:len(work)-1]
+		addr, stack := state.addr, state.stack
+
+		if addr >= len(tc.program) {
+			if !isMain {
+				panic(fmt.Sprintf("%s: function without a return", tc.locationOf(addr)))
+			}
+			exit(addr, stack)
+			continue
+		}
+
+		inst := tc.program[addr]
+		switch inst.Kind {
+		case InstKindPushInt, InstKindMemPush, InstKindDataPush:
+			visit(addr+1, stack.push(1))
+		case InstKindPushString:
+			visit(addr+1, stack.push(2))
+		case InstKindIntrinsic:
+			switch inst.ValueIntrinsic {
+			case IntrinsicDup:
+				need(addr, stack, 1)
+				if sig, isFun := stack.top(); isFun {
+					visit(addr+1, stack.pushFun(sig))
+				} else {
+					visit(addr+1, stack.push(1))
+				}
+			case IntrinsicCall:
+				need(addr, stack, 1)
+				sig, isFun := stack.top()
+				if !isFun {
+					panic(fmt.Sprintf("%s: 'call' used on a value that is not known to be a function", inst.token.location))
+				}
+				stack = stack.pop(1)
+				need(addr, stack, sig.ins)
+				visit(addr+1, stack.pop(sig.ins).push(sig.outs))
+			case IntrinsicExit:
+				// the program ends here, like a return it doesn't join
+				// the other paths
+				need(addr, stack, 1)
+			default:
+				pops, pushes := intrinsicStackEffect(inst.ValueIntrinsic)
+				need(addr, stack, pops)
+				visit(addr+1, stack.pop(pops).push(pushes))
+			}
+		case InstKindTestCondition:
+			need(addr, stack, 1)
+			visit(addr+1, stack.pop(1))
+			visit(inst.JmpAddress, stack.pop(1))
+		case InstKindForStart:
+			need(addr, stack, 2)
+			visit(addr+1, stack.pop(2))
+		case InstKindForTest:
+			visit(addr+1, stack)
+			visit(inst.JmpAddress, stack)
+		case InstKindForNext:
+			visit(inst.JmpAddress, stack)
+		case InstKindForEnd:
+			visit(addr+1, stack)
+		case InstKindForIndex:
+			visit(addr+1, stack.push(1))
+		case InstKindMatch:
+			need(addr, stack, 1)
+			for _, c := range inst.ValueCases {
+				visit(c.Address, stack.pop(1))
+			}
+			visit(inst.JmpAddress, stack.pop(1))
+		case InstKindElse, InstKindElif, InstKindCase, InstKindEnd, InstKindJump, InstKindBreak, InstKindContinue, InstKindFunSkip:
+			visit(inst.JmpAddress, stack)
+		case InstKindWhile, InstKindFunDef:
+			visit(addr+1, stack)
+		case InstKindFunRet:
+			exit(addr, stack)
+		case InstKindFunCall:
+			sig, ok := tc.signature(inst.JmpAddress)
+			if !ok {
+				deferred = append(deferred, state)
+				continue
+			}
+			need(addr, stack, sig.ins)
+			visit(addr+1, stack.pop(sig.ins).push(sig.outs))
+		case InstKindFunAddr:
+			visit(addr+1, stack.pushFun(tc.knownSignature(inst.JmpAddress)))
+		case InstKindFunCast:
+			need(addr, stack, 1)
+			visit(addr+1, stack.pop(1).pushFun(tc.knownSignature(inst.JmpAddress)))
+		case InstKindAssert:
+			// the condition and the message
+			need(addr, stack, 3)
+			visit(addr+1, stack.pop(3))
+		case InstKindDrop:
+			need(addr, stack, inst.ValueInt)
+			visit(addr+1, stack.pop(inst.ValueInt))
+		default:
+			panic(fmt.Sprintf("unknown instruction kind '%s'", inst.Kind))
+		}
+	}
+
+	if !isMain && !out.hasExit {
+		panic(fmt.Sprintf("%s: function never returns", tc.locationOf(start)))
+	}
+	return out
+}
+
+func (st stackType) push(n int) stackType {
+	st.depth += n
+	return st
+}
+
+func (st stackType) pushFun(sig funSignature) stackType {
+	funs := make([]funSlot, len(st.funs), len(st.funs)+1)
+	copy(funs, st.funs)
+	st.funs = append(funs, funSlot{pos: st.depth, sig: sig})
+	st.depth++
+	return st
+}
+
+func (st stackType) pop(n int) stackType {
+	st.depth -= n
+	for len(st.funs) > 0 && st.funs[len(st.funs)-1].pos >= st.depth {
+		st.funs = st.funs[:len(st.funs)-1]
+	}
+	return st
+}
+
+// top returns the signature of the value on top of the stack, the second
+// value is false if the value is not known to be a function.
+func (st stackType) top() (funSignature, bool) {
+	if len(st.funs) > 0 && st.funs[len(st.funs)-1].pos == st.depth-1 {
+		return st.funs[len(st.funs)-1].sig, true
+	}
+	return funSignature{}, false
+}
+
+func (st stackType) equal(other stackType) bool {
+	if st.depth != other.depth || len(st.funs) != len(other.funs) {
+		return false
+	}
+	for i := range st.funs {
+		if st.funs[i] != other.funs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (tc *typeChecker) locationOf(addr int) fileLocation {
+	if len(tc.program) == 0 {
+		return fileLocation{}
+	}
+	if addr >= len(tc.program) {
+		addr = len(tc.program) - 1
+	}
+	return tc.program[addr].token.location
+}
+
+// intrinsicStackEffect returns the number of values an intrinsic takes
+// from the stack and the number of values it pushes back.
+func intrinsicStackEffect(intrinsic Intrinsic) (pops int, pushes int) {
+	switch intrinsic {
+	case IntrinsicPlus, IntrinsicMinus, IntrinsicTimes,
+		IntrinsicGreather, IntrinsicLess, IntrinsicNotEqual:
+		return 2, 1
+	case IntrinsicDivMod:
+		return 2, 2
+	case IntrinsicDup:
+		return 1, 2
+	case IntrinsicPrint:
+		return 1, 0
+	case IntrinsicPrintNumber, IntrinsicBufferedWrite:
+		return 2, 0
+	case IntrinsicFlush:
+		return 0, 0
+	case IntrinsicAlloc:
+		return 1, 1
+	case IntrinsicFree:
+		return 1, 0
+	case IntrinsicRealloc:
+		return 2, 1
+	case IntrinsicExit:
+		return 1, 0
+	case IntrinsicSyscall0:
+		return 1, 0
+	case IntrinsicSyscall1:
+		return 2, 0
+	case IntrinsicSyscall2:
+		return 3, 0
+	case IntrinsicSyscall3:
+		return 4, 0
+	case IntrinsicSyscall4:
+		return 5, 0
+	case IntrinsicSyscall5:
+		return 6, 0
+	case IntrinsicSyscall6:
+		return 7, 0
+	case IntrinsicLoad8, IntrinsicLoad32, IntrinsicLoad64:
+		return 1, 1
+	case IntrinsicStore8, IntrinsicStore32, IntrinsicStore64:
+		return 2, 0
+	default:
+		panic(fmt.Sprintf("unknown intrinsic '%s'", intrinsic))
+	}
+}
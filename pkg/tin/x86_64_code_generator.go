@@ -2,80 +2,146 @@ package tin
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 )
 
 type x86_64Generator struct {
-	text    strings.Builder
-	strings []string
+	text       strings.Builder
+	strings    []string
+	data       []DataBlock
+	jumpTables [][]string
+	// size in bytes of the return stack
+	retStackSize int
+	stackCheck   StackCheck
+	// registers holding the values on top of the data stack, the last one
+	// is the top
+	cache []string
+	// registers used by the current instruction
+	busy map[string]bool
+	// the code of the program, the runtime is written directly to text
+	code []asmLine
+	// symbols of the functions by the address of their definition
+	functions map[int]string
+	// number of local labels emitted
+	localLabels int
+}
+
+// asmLine is a line of the generated code: a label, a comment or an
+// instruction with its operands.
+type asmLine struct {
+	label   string
+	comment string
+	op      string
+	args    []string
+}
+
+func (line asmLine) String() string {
+	switch {
+	case line.label != "":
+		return line.label + ":"
+	case line.comment != "":
+		return "  ;; " + line.comment
+	case len(line.args) == 0:
+		return "  " + line.op
+	}
+	return "  " + line.op + " " + strings.Join(line.args, ", ")
 }
 
 const (
-	addressPrefix string = "addr"
-	stringPrefix  string = "str"
+	// the data stack is addressed by r15 and grows down from the top of
+	// data_stack, rsp holds the return addresses of the functions and the
+	// counters of the outer for loops
+	dataStackSize int = 8 * 1024 * 1024
+	// space below the return stack left to the runtime routines
+	retStackReserve int = 256
+
+	// size of the buffer of the output written with 'bwrite' and 'printn'
+	outputBufferSize int = 4096
+
+	// every block of the heap starts with a header holding its size and
+	// the next free block, bigger blocks are mapped on their own and have
+	// the lowest bit of the size set
+	heapHeaderSize    int = 16
+	heapMmapThreshold int = 128 * 1024
+	// the program break grows by multiples of this size
+	heapChunkSize int = 64 * 1024
+
+	addressPrefix   string = "addr"
+	functionPrefix  string = "fn"
+	stringPrefix    string = "str"
+	dataPrefix      string = "data"
+	jumpTablePrefix string = "jmptable"
 )
 
-func generateNasmX8664(program Program) string {
-	gen := x86_64Generator{}
+func generateNasmX8664(program Program, option CompilerOption) string {
+	gen := x86_64Generator{retStackSize: option.returnStackSize(), stackCheck: option.StackCheck}
 
 	// Text section
 	gen.text.WriteString("section .text\n")
 	gen.text.WriteString("global _start\n")
 
-	// Main function
-	{
-		gen.text.WriteString("\n")
-		gen.text.WriteString("print:\n")
-		gen.text.WriteString("  mov     r9, -3689348814741910323\n")
-		gen.text.WriteString("  sub     rsp, 40\n")
-		gen.text.WriteString("  mov     BYTE [rsp+31], 10\n")
-		gen.text.WriteString("  lea     rcx, [rsp+30]\n")
-		gen.text.WriteString(".L2:\n")
-		gen.text.WriteString("  mov     rax, rdi\n")
-		gen.text.WriteString("  lea     r8, [rsp+32]\n")
-		gen.text.WriteString("  mul     r9\n")
-		gen.text.WriteString("  mov     rax, rdi\n")
-		gen.text.WriteString("  sub     r8, rcx\n")
-		gen.text.WriteString("  shr     rdx, 3\n")
-		gen.text.WriteString("  lea     rsi, [rdx+rdx*4]\n")
-		gen.text.WriteString("  add     rsi, rsi\n")
-		gen.text.WriteString("  sub     rax, rsi\n")
-		gen.text.WriteString("  add     eax, 48\n")
-		gen.text.WriteString("  mov     BYTE [rcx], al\n")
-		gen.text.WriteString("  mov     rax, rdi\n")
-		gen.text.WriteString("  mov     rdi, rdx\n")
-		gen.text.WriteString("  mov     rdx, rcx\n")
-		gen.text.WriteString("  sub     rcx, 1\n")
-		gen.text.WriteString("  cmp     rax, 9\n")
-		gen.text.WriteString("  ja      .L2\n")
-		gen.text.WriteString("  lea     rax, [rsp+32]\n")
-		gen.text.WriteString("  mov     edi, 1\n")
-		gen.text.WriteString("  sub     rdx, rax\n")
-		gen.text.WriteString("  xor     eax, eax\n")
-		gen.text.WriteString("  lea     rsi, [rsp+32+rdx]\n")
-		gen.text.WriteString("  mov     rdx, r8\n")
-		gen.text.WriteString("  mov     rax, 1\n")
-		gen.text.WriteString("  syscall\n")
-		gen.text.WriteString("  add     rsp, 40\n")
-		gen.text.WriteString("  ret\n")
-		gen.text.WriteString("\n")
-	}
+	// Runtime
+	generateX8664PrintNumber(&gen)
+	generateX8664BufferedWrite(&gen)
+	generateX8664Heap(&gen)
+	generateX8664ReturnStackOverflow(&gen)
 
 	gen.text.WriteString("_start:\n")
-	gen.text.WriteString("  mov rax, ret_stack\n")
-	gen.text.WriteString("  mov [ret_base], rax\n")
+	gen.text.WriteString(fmt.Sprintf("  mov rsp, ret_stack+%d\n", retStackReserve+gen.retStackSize))
+	gen.text.WriteString(fmt.Sprintf("  mov r15, data_stack+%d\n", dataStackSize))
+	gen.text.WriteString("  ;; the output is flushed at every newline when stdout is a tty\n")
+	gen.text.WriteString("  mov rax, 16\n")
+	gen.text.WriteString("  mov rdi, 1\n")
+	gen.text.WriteString("  mov rsi, 0x5401\n")
+	gen.text.WriteString("  mov rdx, out_buf\n")
+	gen.text.WriteString("  syscall\n")
+	gen.text.WriteString("  test rax, rax\n")
+	gen.text.WriteString("  jnz .stdout_checked\n")
+	gen.text.WriteString("  mov QWORD [out_tty], 1\n")
+	gen.text.WriteString(".stdout_checked:\n")
 
-	for idx, inst := range program {
-		gen.text.WriteString(fmt.Sprintf("%s:\n", getAddrName(idx)))
+	gen.functions = functionSymbols(program)
+
+	// only the targets of jumps and calls have a label, every function has
+	// one so that it can be found in the binary
+	targets := jumpTargets(program)
+	for idx := 0; idx < len(program); idx++ {
+		inst := program[idx]
+		if targets[idx] {
+			gen.spill()
+		}
+		if targets[idx] || inst.Kind == InstKindFunDef {
+			gen.label(gen.addrName(idx))
+		}
+		// a constant followed by a multiplication or a division
+		if option.OptimizationLevel >= 1 && idx+1 < len(program) && !targets[idx+1] &&
+			generateX8664ConstantOp(&gen, inst, program[idx+1]) {
+			idx++
+			continue
+		}
 		generateX8664Instruction(&gen, inst)
 	}
 
-	gen.text.WriteString("\n")
-	gen.text.WriteString(fmt.Sprintf("%s:\n", getAddrName(len(program))))
-	gen.text.WriteString("  ;; exit syscall\n")
-	gen.text.WriteString("  mov rax, 0x3c\n")
-	gen.text.WriteString("  mov rdi, 0\n")
-	gen.text.WriteString("  syscall\n")
+	gen.spill()
+	if targets[len(program)] {
+		gen.label(gen.addrName(len(program)))
+	}
+	gen.emit("call", "flush_output")
+	if len(program) > 0 {
+		generateX8664StackCheck(&gen, program[len(program)-1])
+	}
+	gen.comment("exit syscall")
+	gen.emit("mov", "rax", "0x3c")
+	gen.emit("mov", "rdi", "0")
+	gen.emit("syscall")
+
+	if option.OptimizationLevel >= 1 {
+		gen.code = peepholeX8664(gen.code, gen.jumpTables)
+	}
+	for _, line := range gen.code {
+		gen.text.WriteString(line.String() + "\n")
+	}
 
 	// Data section
 	gen.text.WriteString("\n")
@@ -83,224 +149,980 @@ func generateNasmX8664(program Program) string {
 	for idx, str := range gen.strings {
 		gen.text.WriteString(fmt.Sprintf("%s: db `%s`\n", getStringName(idx), str))
 	}
+	for idx, data := range gen.data {
+		if !data.ReadOnly {
+			generateX8664DataBlock(&gen, idx, data)
+		}
+	}
+
+	// Read only data section
+	gen.text.WriteString("\n")
+	gen.text.WriteString("section .rodata\n")
+	for idx, data := range gen.data {
+		if data.ReadOnly {
+			generateX8664DataBlock(&gen, idx, data)
+		}
+	}
+	gen.text.WriteString("print_digits: db `0123456789abcdef`\n")
+	for idx, table := range gen.jumpTables {
+		gen.text.WriteString(fmt.Sprintf("%s: dq %s\n", getJumpTableName(idx), strings.Join(table, ",")))
+	}
 
 	// Bss section
 	gen.text.WriteString("\n")
 	gen.text.WriteString("section .bss\n")
-	gen.text.WriteString("	ret_base: resq 1\n")
-	gen.text.WriteString("	ret_stack: resb 1024\n")
-	// TODO: set mem size from parser
-	gen.text.WriteString("	mem: resb 640000\n")
+	gen.text.WriteString(fmt.Sprintf("	ret_stack: resb %d\n", retStackReserve+gen.retStackSize))
+	gen.text.WriteString(fmt.Sprintf("	data_stack: resb %d\n", dataStackSize))
+	gen.text.WriteString("	out_len: resq 1\n")
+	gen.text.WriteString("	out_tty: resq 1\n")
+	gen.text.WriteString(fmt.Sprintf("	out_buf: resb %d\n", outputBufferSize))
+	gen.text.WriteString("	free_list: resq 1\n")
+	gen.text.WriteString("	heap_top: resq 1\n")
+	gen.text.WriteString("	heap_end: resq 1\n")
+	if size := memorySize(program); size > 0 {
+		gen.text.WriteString(fmt.Sprintf("	mem: resb %d\n", size))
+	}
 
 	return gen.text.String()
 }
 
 func generateX8664Instruction(gen *x86_64Generator, inst Instruction) {
+	gen.busy = map[string]bool{}
 	switch inst.Kind {
 	case InstKindPushInt:
-		gen.text.WriteString("  ;; push int\n")
-		gen.text.WriteString(fmt.Sprintf("  mov rax, %d\n", inst.ValueInt))
-		gen.text.WriteString("  push rax\n")
+		gen.comment("push int")
+		gen.push(fmt.Sprint(inst.ValueInt))
 	case InstKindPushString:
-		gen.text.WriteString("  ;; push string\n")
-		gen.text.WriteString(fmt.Sprintf("  mov rax, %d\n", len(inst.ValueString)))
-		gen.text.WriteString("  push rax\n")
-		gen.text.WriteString(fmt.Sprintf("  push str_%d\n", len(gen.strings)))
+		str, err := stringLitValue(inst.ValueString)
+		if err != nil {
+			panic(fmt.Sprintf("%s: invalid string literal", inst.token.location))
+		}
+		gen.comment("push string")
+		gen.push(fmt.Sprint(len(str)))
+		gen.push(getStringName(len(gen.strings)))
 		gen.strings = append(gen.strings, inst.ValueString)
 	case InstKindTestCondition:
-		gen.text.WriteString("  ;; test condition\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  test rax, rax\n")
-		gen.text.WriteString(fmt.Sprintf("  jz %s\n", getAddrName(inst.JmpAddress)))
+		gen.comment("test condition")
+		cond := gen.pop()
+		gen.spill()
+		gen.emit("test", cond, cond)
+		gen.emit("jz", gen.addrName(inst.JmpAddress))
 	case InstKindElse:
-		gen.text.WriteString("  ;; else\n")
-		gen.text.WriteString(fmt.Sprintf("  jmp %s\n", getAddrName(inst.JmpAddress)))
+		gen.comment("else")
+		gen.spill()
+		gen.emit("jmp", gen.addrName(inst.JmpAddress))
+	case InstKindElif:
+		gen.comment("elif")
+		gen.spill()
+		gen.emit("jmp", gen.addrName(inst.JmpAddress))
+	case InstKindMatch:
+		generateX8664Match(gen, inst)
+	case InstKindCase:
+		gen.comment("case")
+		gen.spill()
+		gen.emit("jmp", gen.addrName(inst.JmpAddress))
 	case InstKindWhile:
-		gen.text.WriteString("  ;; while\n")
+		gen.comment("while")
 	case InstKindEnd:
-		gen.text.WriteString("  ;; end\n")
-		gen.text.WriteString(fmt.Sprintf("  jmp %s\n", getAddrName(inst.JmpAddress)))
+		gen.comment("end")
+		gen.spill()
+		gen.emit("jmp", gen.addrName(inst.JmpAddress))
+	case InstKindJump:
+		gen.comment("jump")
+		gen.spill()
+		gen.emit("jmp", gen.addrName(inst.JmpAddress))
+	case InstKindBreak:
+		gen.comment("break")
+		gen.spill()
+		gen.emit("jmp", gen.addrName(inst.JmpAddress))
+	case InstKindContinue:
+		gen.comment("continue")
+		gen.spill()
+		gen.emit("jmp", gen.addrName(inst.JmpAddress))
+	case InstKindForStart:
+		// the counter lives in r12 and the limit in r13, the values of an
+		// outer loop are saved in the return stack
+		gen.comment("for start")
+		top := gen.pop()
+		below := gen.pop()
+		gen.spill()
+		generateX8664ReturnStackCheck(gen, inst, 16)
+		gen.emit("push", "r12")
+		gen.emit("push", "r13")
+		if inst.ValueInt > 0 {
+			gen.emit("mov", "r13", top)
+			gen.emit("mov", "r12", below)
+		} else {
+			gen.emit("mov", "r12", top)
+			gen.emit("mov", "r13", below)
+			gen.emit("dec", "r12")
+		}
+	case InstKindForTest:
+		gen.comment("for test")
+		gen.spill()
+		gen.emit("cmp", "r12", "r13")
+		if inst.ValueInt > 0 {
+			gen.emit("jge", gen.addrName(inst.JmpAddress))
+		} else {
+			gen.emit("jl", gen.addrName(inst.JmpAddress))
+		}
+	case InstKindForNext:
+		gen.comment("for next")
+		gen.spill()
+		gen.emit("add", "r12", fmt.Sprint(inst.ValueInt))
+		gen.emit("jmp", gen.addrName(inst.JmpAddress))
+	case InstKindForEnd:
+		gen.comment("for end")
+		gen.emit("pop", "r13")
+		gen.emit("pop", "r12")
+	case InstKindForIndex:
+		gen.comment("for index")
+		gen.push("r12")
 	case InstKindFunSkip:
-		gen.text.WriteString("  ;; fun skip\n")
-		gen.text.WriteString(fmt.Sprintf("  jmp %s\n", getAddrName(inst.JmpAddress)))
+		gen.comment("fun skip")
+		gen.spill()
+		gen.emit("jmp", gen.addrName(inst.JmpAddress))
 	case InstKindFunDef:
-		gen.text.WriteString("  ;; fun def\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  mov rbx, [ret_base]\n")
-		gen.text.WriteString("  mov [rbx], rax\n")
-		gen.text.WriteString("  add rbx, 8\n")
-		gen.text.WriteString("  mov [ret_base], rbx\n")
+		gen.comment("fun def")
+		// the return address is already on the return stack
+		generateX8664ReturnStackCheck(gen, inst, 0)
 	case InstKindFunRet:
-		gen.text.WriteString("  ;; fun ret\n")
-		gen.text.WriteString("  mov rbx, [ret_base]\n")
-		gen.text.WriteString("  sub rbx, 8\n")
-		gen.text.WriteString("  mov [ret_base], rbx\n")
-		gen.text.WriteString("  mov rax, [rbx]\n")
-		gen.text.WriteString("  push rax\n")
-		gen.text.WriteString("  ret\n")
+		gen.comment("fun ret")
+		gen.spill()
+		gen.emit("ret")
 	case InstKindFunCall:
-		gen.text.WriteString("  ;; fun call\n")
-		gen.text.WriteString(fmt.Sprintf("  call %s\n", getAddrName(inst.JmpAddress)))
+		gen.comment("fun call")
+		gen.spill()
+		if inst.TailCall {
+			gen.emit("jmp", gen.addrName(inst.JmpAddress))
+		} else {
+			gen.emit("call", gen.addrName(inst.JmpAddress))
+		}
+	case InstKindFunAddr:
+		gen.comment("fun addr")
+		gen.push(gen.addrName(inst.JmpAddress))
+	case InstKindFunCast:
+		gen.comment("fun cast")
 	case InstKindMemPush:
-		gen.text.WriteString("  ;; mem push\n")
-		gen.text.WriteString("  mov rax, mem\n")
-		gen.text.WriteString(fmt.Sprintf("  add rax, %d\n", inst.ValueMemory))
-		gen.text.WriteString("  push rax\n")
+		gen.comment("mem push")
+		gen.push(fmt.Sprintf("mem+%d", inst.ValueMemory))
+	case InstKindDataPush:
+		gen.comment("data push")
+		gen.push(getDataName(gen.dataIndex(inst.ValueData)))
+	case InstKindAssert:
+		generateX8664Assert(gen, inst)
+	case InstKindDrop:
+		gen.comment("drop")
+		gen.drop(inst.ValueInt)
 	case InstKindIntrinsic:
-		generateX8664Intrinsic(gen, inst.ValueIntrinsic)
+		generateX8664Intrinsic(gen, inst)
 	default:
 		panic(fmt.Sprintf("unknown instruction kind '%s'", inst.Kind))
 	}
 }
 
-func generateX8664Intrinsic(gen *x86_64Generator, intrinsic Intrinsic) {
-	switch intrinsic {
+func generateX8664Intrinsic(gen *x86_64Generator, inst Instruction) {
+	switch inst.ValueIntrinsic {
 	case IntrinsicPlus:
-		gen.text.WriteString("  ;; add\n")
-		gen.text.WriteString("  pop rbx\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  add rax, rbx\n")
-		gen.text.WriteString("  push rax\n")
+		gen.comment("add")
+		b := gen.pop()
+		a := gen.pop()
+		gen.emit("add", a, b)
+		gen.push(a)
 	case IntrinsicMinus:
-		gen.text.WriteString("  ;; sub\n")
-		gen.text.WriteString("  pop rbx\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  sub rax, rbx\n")
-		gen.text.WriteString("  push rax\n")
+		gen.comment("sub")
+		b := gen.pop()
+		a := gen.pop()
+		gen.emit("sub", a, b)
+		gen.push(a)
 	case IntrinsicTimes:
-		gen.text.WriteString("  ;; mul\n")
-		gen.text.WriteString("  pop rbx\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  imul rbx\n")
-		gen.text.WriteString("  push rax\n")
+		gen.comment("mul")
+		b := gen.pop()
+		a := gen.pop()
+		gen.emit("imul", a, b)
+		gen.push(a)
 	case IntrinsicDivMod:
-		gen.text.WriteString("  ;; divmod\n")
-		gen.text.WriteString("  pop rbx\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  xor rdx, rdx\n")
-		gen.text.WriteString("  idiv rbx\n")
-		gen.text.WriteString("  push rax\n")
-		gen.text.WriteString("  push rdx\n")
+		gen.comment("divmod")
+		gen.popInto("rbx")
+		gen.popInto("rax")
+		gen.clobber("rdx")
+		gen.emit("cqo")
+		gen.emit("idiv", "rbx")
+		gen.push("rax")
+		gen.push("rdx")
 	case IntrinsicGreather:
-		gen.text.WriteString("  ;; greather\n")
-		gen.text.WriteString("  mov rcx, 0\n")
-		gen.text.WriteString("  mov rdx, 1\n")
-		gen.text.WriteString("  pop rbx\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  cmp rax, rbx\n")
-		gen.text.WriteString("  cmovg rcx, rdx\n")
-		gen.text.WriteString("  push rcx\n")
+		gen.comment("greather")
+		generateX8664Compare(gen, "setg")
 	case IntrinsicLess:
-		gen.text.WriteString("  ;; less\n")
-		gen.text.WriteString("  mov rcx, 0\n")
-		gen.text.WriteString("  mov rdx, 1\n")
-		gen.text.WriteString("  pop rbx\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  cmp rax, rbx\n")
-		gen.text.WriteString("  cmovl rcx, rdx\n")
-		gen.text.WriteString("  push rcx\n")
+		gen.comment("less")
+		generateX8664Compare(gen, "setl")
 	case IntrinsicNotEqual:
-		gen.text.WriteString("  ;; not equal\n")
-		gen.text.WriteString("  mov rcx, 0\n")
-		gen.text.WriteString("  mov rdx, 1\n")
-		gen.text.WriteString("  pop rbx\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  cmp rax, rbx\n")
-		gen.text.WriteString("  cmovne rcx, rdx\n")
-		gen.text.WriteString("  push rcx\n")
+		gen.comment("not equal")
+		generateX8664Compare(gen, "setne")
 	case IntrinsicDup:
-		gen.text.WriteString("  ;; dup\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  push rax\n")
-		gen.text.WriteString("  push rax\n")
+		gen.comment("dup")
+		a := gen.pop()
+		b := gen.alloc()
+		gen.emit("mov", b, a)
+		gen.push(a)
+		gen.push(b)
 	case IntrinsicPrint:
-		gen.text.WriteString("  ;; print\n")
-		gen.text.WriteString("  pop rdi\n")
-		gen.text.WriteString("  call print\n")
+		gen.comment("print")
+		gen.popInto("rdi")
+		gen.spill()
+		gen.emit("mov", "rsi", fmt.Sprint(10|printNewline))
+		gen.emit("call", "print_number")
+	case IntrinsicPrintNumber:
+		gen.comment("print number")
+		gen.popInto("rsi")
+		gen.popInto("rdi")
+		gen.spill()
+		gen.emit("call", "print_number")
+	case IntrinsicBufferedWrite:
+		gen.comment("buffered write")
+		gen.popInto("rsi")
+		gen.popInto("rdx")
+		gen.spill()
+		gen.emit("call", "buffered_write")
+	case IntrinsicFlush:
+		gen.comment("flush")
+		gen.spill()
+		gen.emit("call", "flush_output")
+	case IntrinsicAlloc:
+		gen.comment("alloc")
+		gen.popInto("rdi")
+		gen.spill()
+		gen.emit("call", "heap_alloc")
+		gen.push("rax")
+	case IntrinsicFree:
+		gen.comment("free")
+		gen.popInto("rdi")
+		gen.spill()
+		gen.emit("call", "heap_free")
+	case IntrinsicRealloc:
+		gen.comment("realloc")
+		gen.popInto("rsi")
+		gen.popInto("rdi")
+		gen.spill()
+		gen.emit("call", "heap_realloc")
+		gen.push("rax")
+	case IntrinsicCall:
+		gen.comment("call")
+		gen.popInto("rax")
+		gen.spill()
+		if inst.TailCall {
+			gen.emit("jmp", "rax")
+		} else {
+			gen.emit("call", "rax")
+		}
+	case IntrinsicExit:
+		gen.comment("exit")
+		gen.spill()
+		gen.emit("call", "flush_output")
+		gen.popInto("rdi")
+		if gen.stackCheck == StackCheckRuntime {
+			// the exit code is kept across the warning
+			gen.emit("push", "rdi")
+			generateX8664StackCheck(gen, inst)
+			gen.emit("pop", "rdi")
+		}
+		gen.emit("mov", "rax", "60")
+		gen.emit("syscall")
 	case IntrinsicSyscall0:
-		gen.text.WriteString("  ;; syscall0\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  syscall\n")
+		gen.comment("syscall0")
+		generateX8664Syscall(gen, 0)
 	case IntrinsicSyscall1:
-		gen.text.WriteString("  ;; syscall1\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  pop rdi\n")
-		gen.text.WriteString("  syscall\n")
+		gen.comment("syscall1")
+		generateX8664Syscall(gen, 1)
 	case IntrinsicSyscall2:
-		gen.text.WriteString("  ;; syscall2\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  pop rdi\n")
-		gen.text.WriteString("  pop rsi\n")
-		gen.text.WriteString("  syscall\n")
+		gen.comment("syscall2")
+		generateX8664Syscall(gen, 2)
 	case IntrinsicSyscall3:
-		gen.text.WriteString("  ;; syscall3\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  pop rdi\n")
-		gen.text.WriteString("  pop rsi\n")
-		gen.text.WriteString("  pop rdx\n")
-		gen.text.WriteString("  syscall\n")
+		gen.comment("syscall3")
+		generateX8664Syscall(gen, 3)
 	case IntrinsicSyscall4:
-		gen.text.WriteString("  ;; syscall4\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  pop rdi\n")
-		gen.text.WriteString("  pop rsi\n")
-		gen.text.WriteString("  pop rdx\n")
-		gen.text.WriteString("  pop r10\n")
-		gen.text.WriteString("  syscall\n")
+		gen.comment("syscall4")
+		generateX8664Syscall(gen, 4)
 	case IntrinsicSyscall5:
-		gen.text.WriteString("  ;; syscall5\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  pop rdi\n")
-		gen.text.WriteString("  pop rsi\n")
-		gen.text.WriteString("  pop rdx\n")
-		gen.text.WriteString("  pop r10\n")
-		gen.text.WriteString("  pop r8\n")
-		gen.text.WriteString("  syscall\n")
+		gen.comment("syscall5")
+		generateX8664Syscall(gen, 5)
 	case IntrinsicSyscall6:
-		gen.text.WriteString("  ;; syscall6\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  pop rdi\n")
-		gen.text.WriteString("  pop rsi\n")
-		gen.text.WriteString("  pop rdx\n")
-		gen.text.WriteString("  pop r10\n")
-		gen.text.WriteString("  pop r8\n")
-		gen.text.WriteString("  pop r9\n")
-		gen.text.WriteString("  syscall\n")
+		gen.comment("syscall6")
+		generateX8664Syscall(gen, 6)
 	case IntrinsicLoad8:
-		gen.text.WriteString("  ;; load 8\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  xor rbx, rbx\n")
-		gen.text.WriteString("  mov bl, [rax]\n")
-		gen.text.WriteString("  push rbx\n")
+		gen.comment("load 8")
+		addr := gen.pop()
+		gen.emit("movzx", addr, fmt.Sprintf("BYTE [%s]", addr))
+		gen.push(addr)
 	case IntrinsicStore8:
-		gen.text.WriteString("  ;; store 8\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  pop rbx\n")
-		gen.text.WriteString("  mov [rax], bl\n")
+		gen.comment("store 8")
+		addr := gen.pop()
+		value := gen.pop()
+		gen.emit("mov", fmt.Sprintf("[%s]", addr), x8664ByteRegisters[value])
 	case IntrinsicLoad32:
-		gen.text.WriteString("  ;; load 32\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  xor rbx, rbx\n")
-		gen.text.WriteString("  mov ebx, [rax]\n")
-		gen.text.WriteString("  push rbx\n")
+		gen.comment("load 32")
+		addr := gen.pop()
+		gen.emit("mov", x8664DwordRegisters[addr], fmt.Sprintf("[%s]", addr))
+		gen.push(addr)
 	case IntrinsicStore32:
-		gen.text.WriteString("  ;; store 32\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  pop rbx\n")
-		gen.text.WriteString("  mov [rax], ebx\n")
+		gen.comment("store 32")
+		addr := gen.pop()
+		value := gen.pop()
+		gen.emit("mov", fmt.Sprintf("[%s]", addr), x8664DwordRegisters[value])
 	case IntrinsicLoad64:
-		gen.text.WriteString("  ;; load 64\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  xor rbx, rbx\n")
-		gen.text.WriteString("  mov rbx, [rax]\n")
-		gen.text.WriteString("  push rbx\n")
+		gen.comment("load 64")
+		addr := gen.pop()
+		gen.emit("mov", addr, fmt.Sprintf("[%s]", addr))
+		gen.push(addr)
 	case IntrinsicStore64:
-		gen.text.WriteString("  ;; store 64\n")
-		gen.text.WriteString("  pop rax\n")
-		gen.text.WriteString("  pop rbx\n")
-		gen.text.WriteString("  mov [rax], rbx\n")
+		gen.comment("store 64")
+		addr := gen.pop()
+		value := gen.pop()
+		gen.emit("mov", fmt.Sprintf("[%s]", addr), value)
 	default:
-		panic(fmt.Sprintf("unknown intrinsic '%s'", intrinsic))
+		panic(fmt.Sprintf("unknown intrinsic '%s'", inst.ValueIntrinsic))
+	}
+}
+
+// generateX8664Compare pushes 1 when the comparison of the two values
+// on top of the stack sets the flag tested by setcc, 0 otherwise.
+func generateX8664Compare(gen *x86_64Generator, setcc string) {
+	b := gen.pop()
+	a := gen.pop()
+	gen.emit("cmp", a, b)
+	gen.emit(setcc, x8664ByteRegisters[a])
+	gen.emit("movzx", a, x8664ByteRegisters[a])
+	gen.push(a)
+}
+
+// generateX8664Syscall pops the syscall number and its args arguments
+// into the registers of the linux calling convention.
+func generateX8664Syscall(gen *x86_64Generator, args int) {
+	gen.popInto("rax")
+	for _, reg := range []string{"rdi", "rsi", "rdx", "r10", "r8", "r9"}[:args] {
+		gen.popInto(reg)
+	}
+	gen.spill()
+	if args > 0 {
+		// the number is known only at runtime, it may be an exit
+		gen.emit("call", "flush_on_exit")
+	}
+	gen.emit("syscall")
+}
+
+// generateX8664PrintNumber emits the routine that writes the number in
+// rdi with the format in rsi, see formatNumber.
+func generateX8664PrintNumber(gen *x86_64Generator) {
+	gen.text.WriteString("\n")
+	gen.text.WriteString("print_number:\n")
+	gen.text.WriteString("  sub     rsp, 88\n")
+	gen.text.WriteString("  lea     rcx, [rsp+80]\n")
+	gen.text.WriteString("  mov     r8, rsi\n")
+	gen.text.WriteString(fmt.Sprintf("  and     r8, %d\n", printBaseMask))
+	gen.text.WriteString("  cmp     r8, 2\n")
+	gen.text.WriteString("  jb      .default_base\n")
+	gen.text.WriteString("  cmp     r8, 16\n")
+	gen.text.WriteString("  jbe     .base_ok\n")
+	gen.text.WriteString(".default_base:\n")
+	gen.text.WriteString("  mov     r8, 10\n")
+	gen.text.WriteString(".base_ok:\n")
+	gen.text.WriteString("  xor     r10, r10\n")
+	gen.text.WriteString(fmt.Sprintf("  test    rsi, %d\n", printSigned))
+	gen.text.WriteString("  jz      .sign_ok\n")
+	gen.text.WriteString("  test    rdi, rdi\n")
+	gen.text.WriteString("  jns     .sign_ok\n")
+	gen.text.WriteString("  neg     rdi\n")
+	gen.text.WriteString("  mov     r10, 1\n")
+	gen.text.WriteString(".sign_ok:\n")
+	gen.text.WriteString(fmt.Sprintf("  test    rsi, %d\n", printNewline))
+	gen.text.WriteString("  jz      .digits\n")
+	gen.text.WriteString("  dec     rcx\n")
+	gen.text.WriteString("  mov     BYTE [rcx], 10\n")
+	gen.text.WriteString(".digits:\n")
+	gen.text.WriteString("  mov     rax, rdi\n")
+	gen.text.WriteString(".next_digit:\n")
+	gen.text.WriteString("  xor     rdx, rdx\n")
+	gen.text.WriteString("  div     r8\n")
+	gen.text.WriteString("  mov     dl, BYTE [print_digits+rdx]\n")
+	gen.text.WriteString("  dec     rcx\n")
+	gen.text.WriteString("  mov     BYTE [rcx], dl\n")
+	gen.text.WriteString("  test    rax, rax\n")
+	gen.text.WriteString("  jnz     .next_digit\n")
+	gen.text.WriteString("  test    r10, r10\n")
+	gen.text.WriteString("  jz      .write\n")
+	gen.text.WriteString("  dec     rcx\n")
+	gen.text.WriteString("  mov     BYTE [rcx], '-'\n")
+	gen.text.WriteString(".write:\n")
+	gen.text.WriteString("  lea     rdx, [rsp+80]\n")
+	gen.text.WriteString("  sub     rdx, rcx\n")
+	gen.text.WriteString(fmt.Sprintf("  test    rsi, %d\n", printStderr))
+	gen.text.WriteString("  mov     rsi, rcx\n")
+	gen.text.WriteString("  jnz     .stderr\n")
+	gen.text.WriteString("  call    buffered_write\n")
+	gen.text.WriteString("  jmp     .done\n")
+	gen.text.WriteString(".stderr:\n")
+	gen.text.WriteString("  ;; what was written to stdout before comes out first\n")
+	gen.text.WriteString("  push    rsi\n")
+	gen.text.WriteString("  push    rdx\n")
+	gen.text.WriteString("  call    flush_output\n")
+	gen.text.WriteString("  pop     rdx\n")
+	gen.text.WriteString("  pop     rsi\n")
+	gen.text.WriteString("  mov     rdi, 2\n")
+	gen.text.WriteString("  mov     rax, 1\n")
+	gen.text.WriteString("  syscall\n")
+	gen.text.WriteString(".done:\n")
+	gen.text.WriteString("  add     rsp, 88\n")
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString("\n")
+}
+
+// generateX8664BufferedWrite emits the routines that append the rdx bytes
+// at rsi to the output buffer and that flush it to stdout. flush_on_exit
+// flushes it when the syscall in rax is an exit, keeping rax and rdi.
+func generateX8664BufferedWrite(gen *x86_64Generator) {
+	gen.text.WriteString("buffered_write:\n")
+	gen.text.WriteString("  mov     rax, [out_len]\n")
+	gen.text.WriteString("  add     rax, rdx\n")
+	gen.text.WriteString(fmt.Sprintf("  cmp     rax, %d\n", outputBufferSize))
+	gen.text.WriteString("  jbe     .copy\n")
+	gen.text.WriteString("  push    rsi\n")
+	gen.text.WriteString("  push    rdx\n")
+	gen.text.WriteString("  call    flush_output\n")
+	gen.text.WriteString("  pop     rdx\n")
+	gen.text.WriteString("  pop     rsi\n")
+	gen.text.WriteString(fmt.Sprintf("  cmp     rdx, %d\n", outputBufferSize))
+	gen.text.WriteString("  jbe     .copy\n")
+	gen.text.WriteString("  ;; too big for the buffer, write it directly\n")
+	gen.text.WriteString("  mov     rax, 1\n")
+	gen.text.WriteString("  mov     rdi, 1\n")
+	gen.text.WriteString("  syscall\n")
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString(".copy:\n")
+	gen.text.WriteString("  mov     rdi, out_buf\n")
+	gen.text.WriteString("  add     rdi, [out_len]\n")
+	gen.text.WriteString("  add     [out_len], rdx\n")
+	gen.text.WriteString("  mov     rcx, rdx\n")
+	gen.text.WriteString("  rep     movsb\n")
+	gen.text.WriteString("  cmp     QWORD [out_tty], 0\n")
+	gen.text.WriteString("  je      .done\n")
+	gen.text.WriteString("  test    rdx, rdx\n")
+	gen.text.WriteString("  jz      .done\n")
+	gen.text.WriteString("  ;; look for a newline in the copied bytes\n")
+	gen.text.WriteString("  sub     rdi, rdx\n")
+	gen.text.WriteString("  mov     rcx, rdx\n")
+	gen.text.WriteString("  mov     al, 10\n")
+	gen.text.WriteString("  repne   scasb\n")
+	gen.text.WriteString("  jne     .done\n")
+	gen.text.WriteString("  call    flush_output\n")
+	gen.text.WriteString(".done:\n")
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString("\n")
+	gen.text.WriteString("flush_on_exit:\n")
+	gen.text.WriteString(fmt.Sprintf("  cmp     rax, %d\n", syscallExit))
+	gen.text.WriteString("  je      .flush\n")
+	gen.text.WriteString(fmt.Sprintf("  cmp     rax, %d\n", syscallExitGroup))
+	gen.text.WriteString("  jne     .done\n")
+	gen.text.WriteString(".flush:\n")
+	gen.text.WriteString("  push    rax\n")
+	gen.text.WriteString("  push    rdi\n")
+	gen.text.WriteString("  call    flush_output\n")
+	gen.text.WriteString("  pop     rdi\n")
+	gen.text.WriteString("  pop     rax\n")
+	gen.text.WriteString(".done:\n")
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString("\n")
+	gen.text.WriteString("flush_output:\n")
+	gen.text.WriteString("  mov     rdx, [out_len]\n")
+	gen.text.WriteString("  test    rdx, rdx\n")
+	gen.text.WriteString("  jz      .done\n")
+	gen.text.WriteString("  mov     rax, 1\n")
+	gen.text.WriteString("  mov     rdi, 1\n")
+	gen.text.WriteString("  mov     rsi, out_buf\n")
+	gen.text.WriteString("  syscall\n")
+	gen.text.WriteString("  mov     QWORD [out_len], 0\n")
+	gen.text.WriteString(".done:\n")
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString("\n")
+}
+
+// generateX8664Heap emits the allocator routines: heap_alloc returns in
+// rax a block of rdi bytes, heap_free releases the block in rdi and
+// heap_realloc resizes the block in rdi to rsi bytes. Failures return 0.
+func generateX8664Heap(gen *x86_64Generator) {
+	gen.text.WriteString("heap_alloc:\n")
+	gen.text.WriteString("  ;; a negative size is too big, like the mmap would fail\n")
+	gen.text.WriteString("  test    rdi, rdi\n")
+	gen.text.WriteString("  js      .fail\n")
+	gen.text.WriteString(fmt.Sprintf("  add     rdi, %d\n", heapHeaderSize-1))
+	gen.text.WriteString(fmt.Sprintf("  and     rdi, -%d\n", heapHeaderSize))
+	gen.text.WriteString("  jnz     .size_ok\n")
+	gen.text.WriteString(fmt.Sprintf("  mov     rdi, %d\n", heapHeaderSize))
+	gen.text.WriteString(".size_ok:\n")
+	gen.text.WriteString(fmt.Sprintf("  cmp     rdi, %d\n", heapMmapThreshold))
+	gen.text.WriteString("  jae     .mmap\n")
+	gen.text.WriteString("  ;; first fit in the free list, rcx points to the link to the block\n")
+	gen.text.WriteString("  mov     rcx, free_list\n")
+	gen.text.WriteString(".search:\n")
+	gen.text.WriteString("  mov     rax, [rcx]\n")
+	gen.text.WriteString("  test    rax, rax\n")
+	gen.text.WriteString("  jz      .grow\n")
+	gen.text.WriteString("  cmp     [rax], rdi\n")
+	gen.text.WriteString("  jae     .found\n")
+	gen.text.WriteString("  lea     rcx, [rax+8]\n")
+	gen.text.WriteString("  jmp     .search\n")
+	gen.text.WriteString(".found:\n")
+	gen.text.WriteString("  mov     rdx, [rax+8]\n")
+	gen.text.WriteString("  mov     [rcx], rdx\n")
+	gen.text.WriteString(fmt.Sprintf("  add     rax, %d\n", heapHeaderSize))
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString(".grow:\n")
+	gen.text.WriteString("  mov     rax, [heap_top]\n")
+	gen.text.WriteString("  test    rax, rax\n")
+	gen.text.WriteString("  jnz     .top_ok\n")
+	gen.text.WriteString("  push    rdi\n")
+	gen.text.WriteString("  mov     rax, 12\n")
+	gen.text.WriteString("  xor     rdi, rdi\n")
+	gen.text.WriteString("  syscall\n")
+	gen.text.WriteString("  pop     rdi\n")
+	gen.text.WriteString("  mov     [heap_top], rax\n")
+	gen.text.WriteString("  mov     [heap_end], rax\n")
+	gen.text.WriteString(".top_ok:\n")
+	gen.text.WriteString(fmt.Sprintf("  lea     rdx, [rax+rdi+%d]\n", heapHeaderSize))
+	gen.text.WriteString("  cmp     rdx, [heap_end]\n")
+	gen.text.WriteString("  jbe     .carve\n")
+	gen.text.WriteString("  push    rdi\n")
+	gen.text.WriteString("  push    rdx\n")
+	gen.text.WriteString("  mov     rdi, rdx\n")
+	gen.text.WriteString(fmt.Sprintf("  add     rdi, %d\n", heapChunkSize-1))
+	gen.text.WriteString(fmt.Sprintf("  and     rdi, -%d\n", heapChunkSize))
+	gen.text.WriteString("  mov     rax, 12\n")
+	gen.text.WriteString("  syscall\n")
+	gen.text.WriteString("  pop     rdx\n")
+	gen.text.WriteString("  pop     rdi\n")
+	gen.text.WriteString("  cmp     rax, rdx\n")
+	gen.text.WriteString("  jb      .fail\n")
+	gen.text.WriteString("  mov     [heap_end], rax\n")
+	gen.text.WriteString("  mov     rax, [heap_top]\n")
+	gen.text.WriteString(".carve:\n")
+	gen.text.WriteString("  mov     [rax], rdi\n")
+	gen.text.WriteString("  mov     QWORD [rax+8], 0\n")
+	gen.text.WriteString("  mov     [heap_top], rdx\n")
+	gen.text.WriteString(fmt.Sprintf("  add     rax, %d\n", heapHeaderSize))
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString(".mmap:\n")
+	gen.text.WriteString("  push    rdi\n")
+	gen.text.WriteString("  mov     rsi, rdi\n")
+	gen.text.WriteString(fmt.Sprintf("  add     rsi, %d\n", heapHeaderSize))
+	gen.text.WriteString("  mov     rax, 9\n")
+	gen.text.WriteString("  xor     rdi, rdi\n")
+	gen.text.WriteString("  mov     rdx, 3\n")
+	gen.text.WriteString("  mov     r10, 0x22\n")
+	gen.text.WriteString("  mov     r8, -1\n")
+	gen.text.WriteString("  xor     r9, r9\n")
+	gen.text.WriteString("  syscall\n")
+	gen.text.WriteString("  pop     rdi\n")
+	gen.text.WriteString("  cmp     rax, -4096\n")
+	gen.text.WriteString("  ja      .fail\n")
+	gen.text.WriteString("  or      rdi, 1\n")
+	gen.text.WriteString("  mov     [rax], rdi\n")
+	gen.text.WriteString(fmt.Sprintf("  add     rax, %d\n", heapHeaderSize))
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString(".fail:\n")
+	gen.text.WriteString("  xor     rax, rax\n")
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString("\n")
+
+	gen.text.WriteString("heap_free:\n")
+	gen.text.WriteString("  test    rdi, rdi\n")
+	gen.text.WriteString("  jz      .done\n")
+	gen.text.WriteString(fmt.Sprintf("  sub     rdi, %d\n", heapHeaderSize))
+	gen.text.WriteString("  mov     rsi, [rdi]\n")
+	gen.text.WriteString("  test    rsi, 1\n")
+	gen.text.WriteString("  jnz     .munmap\n")
+	gen.text.WriteString("  mov     rax, [free_list]\n")
+	gen.text.WriteString("  mov     [rdi+8], rax\n")
+	gen.text.WriteString("  mov     [free_list], rdi\n")
+	gen.text.WriteString(".done:\n")
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString(".munmap:\n")
+	gen.text.WriteString("  and     rsi, -2\n")
+	gen.text.WriteString(fmt.Sprintf("  add     rsi, %d\n", heapHeaderSize))
+	gen.text.WriteString("  mov     rax, 11\n")
+	gen.text.WriteString("  syscall\n")
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString("\n")
+
+	gen.text.WriteString("heap_realloc:\n")
+	gen.text.WriteString("  test    rdi, rdi\n")
+	gen.text.WriteString("  jnz     .resize\n")
+	gen.text.WriteString("  mov     rdi, rsi\n")
+	gen.text.WriteString("  jmp     heap_alloc\n")
+	gen.text.WriteString(".resize:\n")
+	gen.text.WriteString(fmt.Sprintf("  mov     rax, [rdi-%d]\n", heapHeaderSize))
+	gen.text.WriteString("  and     rax, -2\n")
+	gen.text.WriteString("  cmp     rsi, rax\n")
+	gen.text.WriteString("  jg      .move\n")
+	gen.text.WriteString("  mov     rax, rdi\n")
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString(".move:\n")
+	gen.text.WriteString("  push    rdi\n")
+	gen.text.WriteString("  push    rax\n")
+	gen.text.WriteString("  mov     rdi, rsi\n")
+	gen.text.WriteString("  call    heap_alloc\n")
+	gen.text.WriteString("  pop     rcx\n")
+	gen.text.WriteString("  pop     rsi\n")
+	gen.text.WriteString("  test    rax, rax\n")
+	gen.text.WriteString("  jz      .done\n")
+	gen.text.WriteString("  push    rax\n")
+	gen.text.WriteString("  push    rsi\n")
+	gen.text.WriteString("  mov     rdi, rax\n")
+	gen.text.WriteString("  rep     movsb\n")
+	gen.text.WriteString("  pop     rdi\n")
+	gen.text.WriteString("  call    heap_free\n")
+	gen.text.WriteString("  pop     rax\n")
+	gen.text.WriteString(".done:\n")
+	gen.text.WriteString("  ret\n")
+	gen.text.WriteString("\n")
+}
+
+// generateX8664ReturnStackCheck aborts the program when there is no
+// space for size more bytes on the return stack.
+func generateX8664ReturnStackCheck(gen *x86_64Generator, inst Instruction, size int) {
+	message := returnStackOverflowMessage(inst) + "\\n"
+	gen.emit("cmp", "rsp", fmt.Sprintf("ret_stack+%d", retStackReserve+size))
+	ok := gen.localLabel("ret_ok")
+	gen.emit("jae", ok)
+	gen.emit("mov", "rsi", getStringName(gen.stringIndex(message)))
+	gen.emit("mov", "rdx", fmt.Sprint(len(returnStackOverflowMessage(inst))+1))
+	gen.emit("jmp", "return_stack_overflow")
+	gen.label(ok)
+}
+
+// generateX8664ReturnStackOverflow emits the routine that writes the
+// message at rsi of rdx bytes to stderr and exits with status 1.
+func generateX8664ReturnStackOverflow(gen *x86_64Generator) {
+	gen.text.WriteString("return_stack_overflow:\n")
+	gen.text.WriteString("  push    rdx\n")
+	gen.text.WriteString("  push    rsi\n")
+	gen.text.WriteString("  call    flush_output\n")
+	gen.text.WriteString("  pop     rsi\n")
+	gen.text.WriteString("  pop     rdx\n")
+	gen.text.WriteString("  mov     rax, 1\n")
+	gen.text.WriteString("  mov     rdi, 2\n")
+	gen.text.WriteString("  syscall\n")
+	gen.text.WriteString("  mov     rax, 60\n")
+	gen.text.WriteString("  mov     rdi, 1\n")
+	gen.text.WriteString("  syscall\n")
+	gen.text.WriteString("\n")
+}
+
+// generateX8664Match jumps to the case matching the value on top of the
+// stack. When the cases are dense enough it uses a jump table, otherwise
+// it compares the value with each case.
+func generateX8664Match(gen *x86_64Generator, inst Instruction) {
+	cases := inst.ValueCases
+	minValue, maxValue := cases[0].Value, cases[0].Value
+	for _, c := range cases {
+		if c.Value < minValue {
+			minValue = c.Value
+		}
+		if c.Value > maxValue {
+			maxValue = c.Value
+		}
+	}
+	tableSize := maxValue - minValue + 1
+
+	gen.comment("match")
+	gen.popInto("rax")
+	gen.spill()
+	if len(cases) >= 3 && tableSize > 0 && tableSize <= 2*len(cases) {
+		table := make([]string, tableSize)
+		for i := range table {
+			table[i] = gen.addrName(inst.JmpAddress)
+		}
+		for _, c := range cases {
+			table[c.Value-minValue] = gen.addrName(c.Address)
+		}
+		gen.emit("mov", "rbx", fmt.Sprint(minValue))
+		gen.emit("sub", "rax", "rbx")
+		gen.emit("cmp", "rax", fmt.Sprint(tableSize-1))
+		gen.emit("ja", gen.addrName(inst.JmpAddress))
+		gen.emit("jmp", fmt.Sprintf("[%s+rax*8]", getJumpTableName(len(gen.jumpTables))))
+		gen.jumpTables = append(gen.jumpTables, table)
+	} else {
+		for _, c := range cases {
+			gen.emit("mov", "rbx", fmt.Sprint(c.Value))
+			gen.emit("cmp", "rax", "rbx")
+			gen.emit("je", gen.addrName(c.Address))
+		}
+		gen.emit("jmp", gen.addrName(inst.JmpAddress))
+	}
+}
+
+// generateX8664Assert exits with status 1 after writing the location and
+// the message of the assert to stderr when the condition is zero.
+func generateX8664Assert(gen *x86_64Generator, inst Instruction) {
+	prefix := fmt.Sprintf("%s: assertion failed: ", inst.token.location)
+
+	gen.comment("assert")
+	gen.popInto("rsi")
+	gen.popInto("rdx")
+	cond := gen.pop()
+	gen.emit("test", cond, cond)
+	ok := gen.localLabel("assert_ok")
+	gen.emit("jnz", ok)
+	gen.emit("push", "rdx")
+	gen.emit("push", "rsi")
+	gen.emit("call", "flush_output")
+	generateX8664WriteStderr(gen, getStringName(gen.stringIndex(prefix)), fmt.Sprint(len(prefix)))
+	gen.emit("pop", "rsi")
+	gen.emit("pop", "rdx")
+	gen.emit("mov", "rax", "1")
+	gen.emit("mov", "rdi", "2")
+	gen.emit("syscall")
+	generateX8664WriteStderr(gen, getStringName(gen.stringIndex("\\n")), "1")
+	gen.emit("mov", "rax", "60")
+	gen.emit("mov", "rdi", "1")
+	gen.emit("syscall")
+	gen.label(ok)
+}
+
+// generateX8664StackCheck warns when the program ending at inst leaves
+// values on the data stack and the check is done at runtime.
+func generateX8664StackCheck(gen *x86_64Generator, inst Instruction) {
+	if gen.stackCheck != StackCheckRuntime {
+		return
+	}
+	warning := leftoverStackWarning(inst.token.location)
+	gen.comment("stack check")
+	gen.emit("cmp", "r15", fmt.Sprintf("data_stack+%d", dataStackSize))
+	ok := gen.localLabel("stack_ok")
+	gen.emit("je", ok)
+	generateX8664WriteStderr(gen, getStringName(gen.stringIndex(warning+"\\n")), fmt.Sprint(len(warning)+1))
+	gen.label(ok)
+}
+
+func generateX8664WriteStderr(gen *x86_64Generator, buf string, size string) {
+	gen.emit("mov", "rax", "1")
+	gen.emit("mov", "rdi", "2")
+	gen.emit("mov", "rsi", buf)
+	gen.emit("mov", "rdx", size)
+	gen.emit("syscall")
+}
+
+// registers that can hold the values on top of the data stack
+var x8664CacheRegisters = []string{"rax", "rbx", "rcx", "rdx", "rsi", "rdi", "r8", "r9", "r10", "r11"}
+
+var x8664ByteRegisters = map[string]string{
+	"rax": "al", "rbx": "bl", "rcx": "cl", "rdx": "dl", "rsi": "sil",
+	"rdi": "dil", "r8": "r8b", "r9": "r9b", "r10": "r10b", "r11": "r11b",
+}
+
+var x8664DwordRegisters = map[string]string{
+	"rax": "eax", "rbx": "ebx", "rcx": "ecx", "rdx": "edx", "rsi": "esi",
+	"rdi": "edi", "r8": "r8d", "r9": "r9d", "r10": "r10d", "r11": "r11d",
+}
+
+// addrName returns the label of the instruction at addr.
+func (gen *x86_64Generator) addrName(addr int) string {
+	if name, ok := gen.functions[addr]; ok {
+		return name
+	}
+	return getAddrName(addr)
+}
+
+// localLabel returns a new local label starting with name.
+func (gen *x86_64Generator) localLabel(name string) string {
+	gen.localLabels++
+	return fmt.Sprintf(".%s_%d", name, gen.localLabels)
+}
+
+func (gen *x86_64Generator) emit(op string, args ...string) {
+	gen.code = append(gen.code, asmLine{op: op, args: args})
+}
+
+func (gen *x86_64Generator) label(name string) {
+	gen.code = append(gen.code, asmLine{label: name})
+}
+
+func (gen *x86_64Generator) comment(text string) {
+	gen.code = append(gen.code, asmLine{comment: text})
+}
+
+// push pushes operand to the data stack, the value is kept in a register
+// until the cache is spilled.
+func (gen *x86_64Generator) push(operand string) {
+	if _, ok := x8664ByteRegisters[operand]; ok && gen.cacheIndex(operand) < 0 {
+		gen.cache = append(gen.cache, operand)
+		return
+	}
+	reg := gen.alloc()
+	gen.emit("mov", reg, operand)
+	gen.cache = append(gen.cache, reg)
+}
+
+// pop pops the top of the data stack and returns the register holding
+// it, the register stays reserved until the end of the instruction.
+func (gen *x86_64Generator) pop() string {
+	if len(gen.cache) > 0 {
+		reg := gen.cache[len(gen.cache)-1]
+		gen.cache = gen.cache[:len(gen.cache)-1]
+		gen.busy[reg] = true
+		return reg
+	}
+	reg := gen.alloc()
+	gen.emit("mov", reg, "[r15]")
+	gen.emit("add", "r15", "8")
+	return reg
+}
+
+// popInto pops the top of the data stack into reg.
+func (gen *x86_64Generator) popInto(reg string) {
+	if len(gen.cache) > 0 && gen.cache[len(gen.cache)-1] == reg {
+		gen.pop()
+		return
+	}
+	gen.clobber(reg)
+	gen.busy[reg] = true
+	if len(gen.cache) > 0 {
+		top := gen.cache[len(gen.cache)-1]
+		gen.cache = gen.cache[:len(gen.cache)-1]
+		gen.emit("mov", reg, top)
+	} else {
+		gen.emit("mov", reg, "[r15]")
+		gen.emit("add", "r15", "8")
+	}
+}
+
+// clobber moves the value held by reg to another register so that the
+// instruction can overwrite it.
+func (gen *x86_64Generator) clobber(reg string) {
+	idx := gen.cacheIndex(reg)
+	if idx < 0 {
+		return
+	}
+	gen.busy[reg] = true
+	free := gen.alloc()
+	if free == reg {
+		// every register was in use and alloc spilled reg to memory
+		return
+	}
+	gen.emit("mov", free, reg)
+	gen.cache[gen.cacheIndex(reg)] = free
+	gen.busy[free] = false
+}
+
+// drop removes count values from the top of the data stack.
+func (gen *x86_64Generator) drop(count int) {
+	cached := count
+	if cached > len(gen.cache) {
+		cached = len(gen.cache)
+	}
+	gen.cache = gen.cache[:len(gen.cache)-cached]
+	if count > cached {
+		gen.emit("add", "r15", fmt.Sprint(8*(count-cached)))
+	}
+}
+
+// alloc reserves a register that doesn't hold any value, spilling the
+// bottom of the cache when they are all in use.
+func (gen *x86_64Generator) alloc() string {
+	for _, reg := range x8664CacheRegisters {
+		if !gen.busy[reg] && gen.cacheIndex(reg) < 0 {
+			gen.busy[reg] = true
+			return reg
+		}
+	}
+	if len(gen.cache) == 0 {
+		panic("no free register")
+	}
+	reg := gen.cache[0]
+	gen.cache = gen.cache[1:]
+	gen.emit("sub", "r15", "8")
+	gen.emit("mov", "[r15]", reg)
+	gen.busy[reg] = true
+	return reg
+}
+
+// spill writes the values held in registers to the data stack in memory,
+// it must be called before every jump, call and jump target.
+func (gen *x86_64Generator) spill() {
+	if len(gen.cache) == 0 {
+		return
+	}
+	// lea leaves the flags untouched, a comparison before the spill can
+	// still be fused with the branch after it
+	gen.emit("lea", "r15", fmt.Sprintf("[r15-%d]", 8*len(gen.cache)))
+	for idx, reg := range gen.cache {
+		offset := 8 * (len(gen.cache) - 1 - idx)
+		if offset == 0 {
+			gen.emit("mov", "[r15]", reg)
+		} else {
+			gen.emit("mov", fmt.Sprintf("[r15+%d]", offset), reg)
+		}
+	}
+	gen.cache = nil
+}
+
+func (gen *x86_64Generator) cacheIndex(reg string) int {
+	for idx, r := range gen.cache {
+		if r == reg {
+			return idx
+		}
+	}
+	return -1
+}
+
+// memorySize returns the number of bytes needed by the memories used in
+// program.
+func memorySize(program Program) int {
+	size := 0
+	for _, inst := range program {
+		if inst.Kind == InstKindMemPush && inst.ValueMemory+inst.ValueInt > size {
+			size = inst.ValueMemory + inst.ValueInt
+		}
+	}
+	return size
+}
+
+// stringIndex returns the index of the given string, adding it to the
+// strings to emit the first time it's used.
+func (gen *x86_64Generator) stringIndex(str string) int {
+	for idx, s := range gen.strings {
+		if s == str {
+			return idx
+		}
+	}
+	gen.strings = append(gen.strings, str)
+	return len(gen.strings) - 1
+}
+
+// dataIndex returns the index of the given data block, adding it to the
+// blocks to emit the first time it's used.
+func (gen *x86_64Generator) dataIndex(data DataBlock) int {
+	for idx, d := range gen.data {
+		if d.Name == data.Name {
+			return idx
+		}
+	}
+	gen.data = append(gen.data, data)
+	return len(gen.data) - 1
+}
+
+func generateX8664DataBlock(gen *x86_64Generator, idx int, data DataBlock) {
+	gen.text.WriteString(fmt.Sprintf("%s:\n", getDataName(idx)))
+	for len(data.Bytes) > 0 {
+		line := data.Bytes
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		data.Bytes = data.Bytes[len(line):]
+
+		values := make([]string, len(line))
+		for i, b := range line {
+			values[i] = fmt.Sprint(b)
+		}
+		gen.text.WriteString(fmt.Sprintf("  db %s\n", strings.Join(values, ",")))
 	}
 }
 
@@ -308,6 +1130,63 @@ func getAddrName(addr int) string {
 	return fmt.Sprintf("%s_%d", addressPrefix, addr)
 }
 
+// getFunctionName returns the symbol of the function with the given name,
+// the bytes that can't be part of a symbol are written as '$' followed by
+// their hex value.
+func getFunctionName(name string) string {
+	var symbol strings.Builder
+	symbol.WriteString(functionPrefix + "_")
+	for _, b := range []byte(name) {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '_' || b == '.' {
+			symbol.WriteByte(b)
+		} else {
+			symbol.WriteString(fmt.Sprintf("$%02x", b))
+		}
+	}
+	return symbol.String()
+}
+
+// functionSymbols returns the symbols of the functions of program by the
+// address of their definition. A function is named as it's written in
+// its file, when two of them have the same name they are prefixed by the
+// name of the file and, if they still collide, followed by a number.
+func functionSymbols(program Program) map[int]string {
+	uses := make(map[string]int)
+	for _, inst := range program {
+		if inst.Kind == InstKindFunDef {
+			uses[inst.ValueString]++
+		}
+	}
+
+	symbols := make(map[int]string)
+	taken := make(map[string]bool)
+	for idx, inst := range program {
+		if inst.Kind != InstKindFunDef {
+			continue
+		}
+		name := inst.ValueString
+		if uses[name] > 1 {
+			file := filepath.Base(inst.token.location.fileName)
+			name = strings.TrimSuffix(file, filepath.Ext(file)) + "." + name
+		}
+		symbol := getFunctionName(name)
+		for n := 2; taken[symbol]; n++ {
+			symbol = getFunctionName(fmt.Sprintf("%s.%d", name, n))
+		}
+		taken[symbol] = true
+		symbols[idx] = symbol
+	}
+	return symbols
+}
+
 func getStringName(strNum int) string {
 	return fmt.Sprintf("%s_%d", stringPrefix, strNum)
 }
+
+func getDataName(dataNum int) string {
+	return fmt.Sprintf("%s_%d", dataPrefix, dataNum)
+}
+
+func getJumpTableName(tableNum int) string {
+	return fmt.Sprintf("%s_%d", jumpTablePrefix, tableNum)
+}
@@ -0,0 +1,191 @@
+package tin
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected files in test/golden and test/expected")
+
+// the programs include their libraries with paths relative to the root
+// of the repository
+func chdirRoot(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("../.."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// compileX8664 returns the code generated for the program at path, from
+// _start to the end. The runtime routines before it are the same for
+// every program.
+func compileX8664(t *testing.T, path string, level int) string {
+	option := CompilerOption{InputPath: path, OptimizationLevel: level, StackCheck: StackCheckOff}
+	asm := generateNasmX8664(loadProgram(option, TargetX8664), option)
+	start := strings.Index(asm, "_start:")
+	if start < 0 {
+		t.Fatalf("%s: no _start in the generated code", path)
+	}
+	return asm[start:]
+}
+
+// TestX8664Golden compares the code generated for the programs in
+// test/golden with <name>.O<level>.asm next to them, 'go test -update'
+// rewrites them. The programs are small and exercise the register cache
+// and the peephole optimizer, the behavior of the others is checked by
+// running them.
+func TestX8664Golden(t *testing.T) {
+	chdirRoot(t)
+	paths, err := filepath.Glob("test/golden/*.tin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		for _, level := range []string{"0", "1"} {
+			golden := strings.TrimSuffix(path, ".tin") + ".O" + level + ".asm"
+			got := compileX8664(t, path, int(level[0]-'0'))
+			if *update {
+				if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("%s: the code generated with -O%s differs from %s", path, level, golden)
+			}
+		}
+	}
+}
+
+// TestX8664DataStackAccesses counts the instructions reading or writing
+// the data stack in memory, the values on top of it are kept in
+// registers. The counts of the scheme that moved every value through
+// memory are in the comments.
+func TestX8664DataStackAccesses(t *testing.T) {
+	tests := []struct {
+		source string
+		want   int
+	}{
+		// straight line code never touches memory, was 14
+		{"1 2 + 3 * 4 - print\n", 0},
+		// the arguments of a call are spilled before it, was 10
+		{"def add_one 1 + end\n0 0 1000 for add_one end print\n", 6},
+		// the values are spilled only before the branch, was 24
+		{"memory x 8 end\n10 x !64\nx @64 dup 5 > if x @64 1 + print end print\n", 3},
+	}
+
+	dir := t.TempDir()
+	for i, test := range tests {
+		path := filepath.Join(dir, "program.tin")
+		if err := ioutil.WriteFile(path, []byte(test.source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Count(compileX8664(t, path, 0), "[r15")
+		if got != test.want {
+			t.Errorf("program %d: %d accesses to the data stack, want %d", i, got, test.want)
+		}
+	}
+}
+
+// TestX8664FunctionSymbols checks that the functions are named as they
+// are written, with the file only when two of them have the same name.
+func TestX8664FunctionSymbols(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"lib.tin":  "def puts bwrite end\ndef putd print end\n",
+		"main.tin": "include \"" + filepath.Join(dir, "lib.tin") + "\"\ndef puts bwrite bwrite end\n1 putd \"y\" \"x\" puts\n",
+	}
+	for name, source := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	asm := compileX8664(t, filepath.Join(dir, "main.tin"), 0)
+	for _, symbol := range []string{"fn_putd:", "fn_lib.puts:", "fn_main.puts:"} {
+		if !strings.Contains(asm, "\n"+symbol+"\n") {
+			t.Errorf("no function '%s' in the generated code", symbol)
+		}
+	}
+}
+
+// TestX8664Programs assembles every program in test/ with nasm and checks
+// that the binary behaves like the simulator, it's skipped when nasm is
+// not on the PATH.
+func TestX8664Programs(t *testing.T) {
+	if _, err := exec.LookPath("nasm"); err != nil {
+		t.Skip("nasm is not on the PATH")
+	}
+	chdirRoot(t)
+	dir := t.TempDir()
+	for _, name := range testProgramNames() {
+		if name == "static_if" {
+			// it prints the target
+			continue
+		}
+		want, err := ioutil.ReadFile(filepath.Join("test", "expected", name+".out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, level := range []string{"0", "1"} {
+			option := CompilerOption{
+				InputPath:         filepath.Join("test", name+".tin"),
+				OptimizationLevel: int(level[0] - '0'),
+				StackCheck:        StackCheckOff,
+			}
+			stdout, _, exitCode := runX8664(t, option, filepath.Join(dir, name+".O"+level))
+			if exitCode != testPrograms[name] {
+				t.Errorf("%s: exit code %d with -O%s, want %d", option.InputPath, exitCode, level, testPrograms[name])
+			}
+			if stdout != string(want) {
+				t.Errorf("%s: the output with -O%s differs from the simulator", option.InputPath, level)
+			}
+		}
+	}
+}
+
+// runX8664 compiles the program with nasm and ld to output and runs it,
+// it returns what the program writes to stdout and stderr and its exit
+// code.
+func runX8664(t *testing.T, option CompilerOption, output string) (stdout string, stderr string, exitCode int) {
+	option.OutputPath = output + ".asm"
+	if err := CompileFile(option); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range [][]string{
+		{"nasm", "-felf64", output + ".asm"},
+		{"ld", "-o", output, output + ".o"},
+	} {
+		if out, err := exec.Command(command[0], command[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%s: %s\n%s", strings.Join(command, " "), err, out)
+		}
+	}
+
+	var out, errOut bytes.Buffer
+	binary := exec.Command(output)
+	binary.Stdout = &out
+	binary.Stderr = &errOut
+	if err := binary.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatal(err)
+		}
+		exitCode = exitErr.ExitCode()
+	}
+	return out.String(), errOut.String(), exitCode
+}
@@ -0,0 +1,302 @@
+package tin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maximum number of instructions matched by a peephole rule, enough
+	// to reach a branch after the spill of every cached register
+	peepholeWindowSize int = 16
+)
+
+// conditional jump taken when the flag tested by a setcc is set and
+// when it's not
+var x8664SetccJumps = map[string][2]string{
+	"sete":  {"je", "jne"},
+	"setne": {"jne", "je"},
+	"setg":  {"jg", "jle"},
+	"setge": {"jge", "jl"},
+	"setl":  {"jl", "jge"},
+	"setle": {"jle", "jg"},
+}
+
+// peepholeX8664 replaces short sequences of instructions of code with
+// cheaper equivalent ones until nothing changes. A sequence never spans
+// a label used by a jump, a call or one of the jump tables.
+func peepholeX8664(code []asmLine, jumpTables [][]string) []asmLine {
+	targets := referencedLabels(code, jumpTables)
+	for changed := true; changed; {
+		code, changed = peepholePass(code, targets, matchPeephole)
+	}
+	// zeroing with xor changes the flags so it's done after the rules that
+	// move the instructions reading them
+	code, _ = peepholePass(code, targets, func(code []asmLine, window []int) ([]asmLine, int, bool) {
+		return matchZeroing(code, window)
+	})
+	return code
+}
+
+type peepholeRule func(code []asmLine, window []int) (replacement []asmLine, matched int, ok bool)
+
+// peepholePass applies rule once at every instruction of code, the
+// replacement takes the place of the first matched instruction.
+func peepholePass(code []asmLine, targets map[string]bool, rule peepholeRule) ([]asmLine, bool) {
+	deleted := make([]bool, len(code))
+	replaced := make(map[int][]asmLine)
+	changed := false
+	for i := range code {
+		if code[i].op == "" || deleted[i] {
+			continue
+		}
+		window := peepholeWindow(code, i, targets, deleted)
+		if replacement, matched, ok := rule(code, window); ok {
+			for _, idx := range window[:matched] {
+				deleted[idx] = true
+			}
+			replaced[i] = replacement
+			changed = true
+		}
+	}
+	if !changed {
+		return code, false
+	}
+
+	out := make([]asmLine, 0, len(code))
+	for i, line := range code {
+		if replacement, ok := replaced[i]; ok {
+			out = append(out, replacement...)
+		} else if !deleted[i] {
+			out = append(out, line)
+		}
+	}
+	return out, true
+}
+
+// peepholeWindow returns the indices of the instructions starting at i
+// that are executed one after the other, comments and unused labels are
+// skipped.
+func peepholeWindow(code []asmLine, i int, targets map[string]bool, deleted []bool) []int {
+	window := []int{}
+	for ; i < len(code) && len(window) < peepholeWindowSize; i++ {
+		switch {
+		case deleted[i]:
+		case code[i].label != "":
+			if targets[code[i].label] {
+				return window
+			}
+		case code[i].op != "":
+			window = append(window, i)
+		}
+	}
+	return window
+}
+
+func matchPeephole(code []asmLine, window []int) ([]asmLine, int, bool) {
+	insts := make([]asmLine, len(window))
+	for i, idx := range window {
+		insts[i] = code[idx]
+	}
+	is := func(i int, op string, args ...string) bool {
+		if i >= len(insts) || insts[i].op != op || len(insts[i].args) != len(args) {
+			return false
+		}
+		for j, arg := range args {
+			if arg != "*" && insts[i].args[j] != arg {
+				return false
+			}
+		}
+		return true
+	}
+	move := func(dst string, src string) []asmLine {
+		if dst == src {
+			return nil
+		}
+		return []asmLine{{op: "mov", args: []string{dst, src}}}
+	}
+
+	switch {
+	// mov rax, rax
+	case is(0, "mov", "*", "*") && insts[0].args[0] == insts[0].args[1]:
+		return nil, 1, true
+	// a value written to the data stack and read back
+	case len(insts) >= 4 && stackOffset(insts[0]) == -8 && is(1, "mov", "[r15]", "*") &&
+		is(2, "mov", "*", "[r15]") && stackOffset(insts[3]) == 8:
+		return move(insts[2].args[0], insts[1].args[1]), 4, true
+	// the same with the return stack
+	case is(0, "push", "*") && is(1, "pop", "*"):
+		return move(insts[1].args[0], insts[0].args[0]), 2, true
+	// consecutive updates of the data stack pointer, lea keeps the flags
+	// of the original instructions out of the way
+	case len(insts) >= 2 && stackOffset(insts[0]) != 0 && stackOffset(insts[1]) != 0:
+		offset := stackOffset(insts[0]) + stackOffset(insts[1])
+		switch {
+		case offset > 0:
+			return []asmLine{{op: "lea", args: []string{"r15", fmt.Sprintf("[r15+%d]", offset)}}}, 2, true
+		case offset < 0:
+			return []asmLine{{op: "lea", args: []string{"r15", fmt.Sprintf("[r15-%d]", -offset)}}}, 2, true
+		}
+		return nil, 2, true
+	// a comparison whose result is only used by a branch, the register
+	// tested by the branch is never used after it
+	case len(insts) >= 4 && strings.HasPrefix(insts[0].op, "set") && is(1, "movzx", "*", insts[0].args[0]):
+		return fuseCompareBranch(insts)
+	// a pop of the data stack pointer moved after the access that follows
+	// it, so that it meets the next update of r15 and they are merged
+	case len(insts) >= 2 && stackOffset(insts[0]) > 0:
+		if access, ok := rebaseStackAccess(insts[1], stackOffset(insts[0])); ok {
+			return []asmLine{access, insts[0]}, 2, true
+		}
+	}
+	return nil, 0, false
+}
+
+// fuseCompareBranch replaces the setcc, movzx, test and jz or jnz at the
+// start of insts with a single conditional jump. The instructions between
+// the movzx and the test are kept when they don't change the flags nor
+// use the register with the result of the comparison.
+func fuseCompareBranch(insts []asmLine) ([]asmLine, int, bool) {
+	jumps, ok := x8664SetccJumps[insts[0].op]
+	if !ok {
+		return nil, 0, false
+	}
+	reg := insts[1].args[0]
+	names := []string{reg, x8664ByteRegisters[reg], x8664DwordRegisters[reg]}
+
+	for k := 2; k+1 < len(insts); k++ {
+		inst := insts[k]
+		if inst.op == "test" && len(inst.args) == 2 && inst.args[0] == reg && inst.args[1] == reg &&
+			(insts[k+1].op == "jz" || insts[k+1].op == "jnz") {
+			jump := jumps[0]
+			if insts[k+1].op == "jz" {
+				jump = jumps[1]
+			}
+			replacement := append([]asmLine{}, insts[2:k]...)
+			return append(replacement, asmLine{op: jump, args: insts[k+1].args}), k + 2, true
+		}
+		if inst.op != "mov" && inst.op != "lea" {
+			break
+		}
+		for _, arg := range inst.args {
+			for _, name := range names {
+				if strings.Contains(arg, name) {
+					return nil, 0, false
+				}
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+// matchZeroing replaces mov reg, 0 with the shorter xor when the flags
+// are set again before being read.
+func matchZeroing(code []asmLine, window []int) ([]asmLine, int, bool) {
+	if len(window) == 0 {
+		return nil, 0, false
+	}
+	inst := code[window[0]]
+	if inst.op != "mov" || len(inst.args) != 2 || inst.args[1] != "0" {
+		return nil, 0, false
+	}
+	reg, ok := x8664DwordRegisters[inst.args[0]]
+	if !ok || !flagsDeadAfter(code, window[0]) {
+		return nil, 0, false
+	}
+	return []asmLine{{op: "xor", args: []string{reg, reg}}}, 1, true
+}
+
+// flagsDeadAfter returns true if the flags are written before being read
+// by the instructions that follow the one at i.
+func flagsDeadAfter(code []asmLine, i int) bool {
+	for _, line := range code[i+1:] {
+		switch {
+		case line.op == "":
+		case strings.HasPrefix(line.op, "j"), strings.HasPrefix(line.op, "set"),
+			strings.HasPrefix(line.op, "cmov"), line.op == "adc", line.op == "sbb":
+			return false
+		}
+		switch line.op {
+		case "add", "sub", "cmp", "test", "xor", "and", "or", "imul", "idiv",
+			"inc", "dec", "neg", "shl", "shr", "sar", "call", "ret", "syscall":
+			return true
+		}
+	}
+	return true
+}
+
+// stackOffset returns how much inst moves the data stack pointer, 0 when
+// it doesn't change it.
+func stackOffset(inst asmLine) int {
+	if len(inst.args) != 2 || inst.args[0] != "r15" {
+		return 0
+	}
+	arg := inst.args[1]
+	if inst.op == "lea" && strings.HasPrefix(arg, "[r15") && strings.HasSuffix(arg, "]") {
+		arg = strings.TrimSuffix(strings.TrimPrefix(arg, "[r15"), "]")
+	} else if inst.op != "add" && inst.op != "sub" {
+		return 0
+	}
+	offset, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0
+	}
+	if inst.op == "sub" {
+		return -offset
+	}
+	return offset
+}
+
+// rebaseStackAccess returns inst, a mov from or to the data stack, with
+// the address changed to be used before moving r15 by offset.
+func rebaseStackAccess(inst asmLine, offset int) (asmLine, bool) {
+	if inst.op != "mov" || len(inst.args) != 2 {
+		return asmLine{}, false
+	}
+	args := make([]string, 2)
+	rebased := false
+	for i, arg := range inst.args {
+		args[i] = arg
+		if !strings.Contains(arg, "r15") {
+			continue
+		}
+		if arg == "r15" || rebased {
+			return asmLine{}, false
+		}
+		current := 0
+		if arg != "[r15]" {
+			value, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(arg, "[r15"), "]"))
+			if err != nil || !strings.HasSuffix(arg, "]") {
+				return asmLine{}, false
+			}
+			current = value
+		}
+		args[i] = fmt.Sprintf("[r15%+d]", current+offset)
+		if current+offset == 0 {
+			args[i] = "[r15]"
+		}
+		rebased = true
+	}
+	if !rebased {
+		return asmLine{}, false
+	}
+	return asmLine{op: inst.op, args: args}, true
+}
+
+// referencedLabels returns the labels used as an operand in code or in
+// one of the jump tables.
+func referencedLabels(code []asmLine, jumpTables [][]string) map[string]bool {
+	labels := make(map[string]bool)
+	for _, line := range code {
+		for _, arg := range line.args {
+			labels[arg] = true
+		}
+	}
+	for _, table := range jumpTables {
+		for _, label := range table {
+			labels[label] = true
+		}
+	}
+	return labels
+}
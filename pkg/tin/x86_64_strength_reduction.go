@@ -0,0 +1,190 @@
+package tin
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// generateX8664ConstantOp emits a cheaper sequence of instructions for
+// a multiplication or a division by the constant pushed by push. It
+// returns false, without emitting anything, when op is not one of them
+// or the constant has no better sequence.
+func generateX8664ConstantOp(gen *x86_64Generator, push Instruction, op Instruction) bool {
+	if push.Kind != InstKindPushInt || op.Kind != InstKindIntrinsic {
+		return false
+	}
+	gen.busy = map[string]bool{}
+	switch op.ValueIntrinsic {
+	case IntrinsicTimes:
+		return generateX8664MulConst(gen, push.ValueInt)
+	case IntrinsicDivMod:
+		return generateX8664DivModConst(gen, push.ValueInt)
+	}
+	return false
+}
+
+// generateX8664MulConst multiplies the top of the data stack by c using
+// shifts and lea when c is a power of two or a power of two times 3, 5
+// or 9, and the immediate form of imul otherwise.
+func generateX8664MulConst(gen *x86_64Generator, c int) bool {
+	// the absolute value of math.MinInt64 is still a power of two
+	abs := uint64(c)
+	if c < 0 {
+		abs = -abs
+	}
+	shift := bits.TrailingZeros64(abs)
+	factor := abs >> shift
+
+	switch {
+	case c == 0:
+		gen.comment(fmt.Sprintf("mul by %d", c))
+		gen.drop(1)
+		gen.push("0")
+	case factor == 1 || factor == 3 || factor == 5 || factor == 9:
+		gen.comment(fmt.Sprintf("mul by %d", c))
+		a := gen.pop()
+		if factor > 1 {
+			gen.emit("lea", a, fmt.Sprintf("[%s+%s*%d]", a, a, factor-1))
+		}
+		if shift > 0 {
+			gen.emit("shl", a, fmt.Sprint(shift))
+		}
+		if c < 0 {
+			gen.emit("neg", a)
+		}
+		gen.push(a)
+	case c >= math.MinInt32 && c <= math.MaxInt32:
+		gen.comment(fmt.Sprintf("mul by %d", c))
+		a := gen.pop()
+		gen.emit("imul", a, a, fmt.Sprint(c))
+		gen.push(a)
+	default:
+		return false
+	}
+	return true
+}
+
+// generateX8664DivModConst divides the top of the data stack by c with
+// shifts when c is a power of two and with a multiplication by the magic
+// number of c otherwise, the results are the same of idiv.
+func generateX8664DivModConst(gen *x86_64Generator, c int) bool {
+	// the division by zero is left to fail at runtime
+	if c == 0 || c == math.MinInt64 {
+		return false
+	}
+	gen.comment(fmt.Sprintf("divmod by %d", c))
+
+	abs := c
+	if c < 0 {
+		abs = -c
+	}
+	switch {
+	case abs == 1:
+		a := gen.pop()
+		if c < 0 {
+			gen.emit("neg", a)
+		}
+		gen.push(a)
+		gen.push("0")
+	case abs&(abs-1) == 0:
+		// the shift rounds toward minus infinity, adding abs-1 to the
+		// negative dividends rounds toward zero like idiv
+		shift := bits.TrailingZeros64(uint64(abs))
+		a := gen.pop()
+		q := gen.alloc()
+		gen.emit("mov", q, a)
+		gen.emit("sar", q, "63")
+		gen.emit("shr", q, fmt.Sprint(64-shift))
+		gen.emit("add", q, a)
+		gen.emit("sar", q, fmt.Sprint(shift))
+		t := gen.alloc()
+		gen.emit("mov", t, q)
+		gen.emit("shl", t, fmt.Sprint(shift))
+		gen.emit("sub", a, t)
+		if c < 0 {
+			gen.emit("neg", q)
+		}
+		gen.push(q)
+		gen.push(a)
+	default:
+		// the one operand imul leaves the high half of the product in rdx
+		multiplier, shift := x8664DivisionMagic(c)
+		a := gen.pop()
+		gen.clobber("rax")
+		gen.clobber("rdx")
+		gen.busy["rax"] = true
+		gen.busy["rdx"] = true
+		if a == "rax" || a == "rdx" {
+			reg := gen.alloc()
+			gen.emit("mov", reg, a)
+			a = reg
+		}
+		gen.emit("mov", "rax", fmt.Sprint(multiplier))
+		gen.emit("imul", a)
+		if c > 0 && multiplier < 0 {
+			gen.emit("add", "rdx", a)
+		} else if c < 0 && multiplier > 0 {
+			gen.emit("sub", "rdx", a)
+		}
+		if shift > 0 {
+			gen.emit("sar", "rdx", fmt.Sprint(shift))
+		}
+		// the quotient of a negative result is rounded toward zero
+		gen.emit("mov", "rax", "rdx")
+		gen.emit("shr", "rax", "63")
+		gen.emit("add", "rdx", "rax")
+		// the remainder is the dividend minus quotient times c
+		if c >= math.MinInt32 && c <= math.MaxInt32 {
+			gen.emit("imul", "rax", "rdx", fmt.Sprint(c))
+		} else {
+			gen.emit("mov", "rax", fmt.Sprint(c))
+			gen.emit("imul", "rax", "rdx")
+		}
+		gen.emit("sub", a, "rax")
+		gen.push("rdx")
+		gen.push(a)
+	}
+	return true
+}
+
+// x8664DivisionMagic returns the multiplier and the shift that replace
+// the signed division by d, see Hacker's Delight 10-4. d can't be -1, 0
+// or 1.
+func x8664DivisionMagic(d int) (multiplier int, shift int) {
+	const two63 uint64 = 1 << 63
+
+	ad := uint64(d)
+	if d < 0 {
+		ad = -ad
+	}
+	t := two63 + uint64(d)>>63
+	anc := t - 1 - t%ad
+	q1, r1 := two63/anc, two63%anc
+	q2, r2 := two63/ad, two63%ad
+
+	p := 63
+	for {
+		p++
+		q1, r1 = 2*q1, 2*r1
+		if r1 >= anc {
+			q1++
+			r1 -= anc
+		}
+		q2, r2 = 2*q2, 2*r2
+		if r2 >= ad {
+			q2++
+			r2 -= ad
+		}
+		delta := ad - r2
+		if q1 > delta || (q1 == delta && r1 != 0) {
+			break
+		}
+	}
+
+	multiplier = int(q2 + 1)
+	if d < 0 {
+		multiplier = -multiplier
+	}
+	return multiplier, p - 64
+}
@@ -0,0 +1,224 @@
+package tin
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// dividends and factors used by the tests, with the edge cases of the
+// signed division
+func strengthReductionOperands() []int {
+	operands := []int{
+		0, 1, -1, 2, -2, 3, -3, 6, -6, 7, -7, 9, 100, -100, 641, -641,
+		12345678901, -12345678901, math.MaxInt32, math.MinInt32,
+		math.MaxInt64, math.MaxInt64 - 1, math.MinInt64, math.MinInt64 + 1,
+	}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 64; i++ {
+		operands = append(operands, int(random.Uint64()), int(random.Uint64()>>uint(random.Intn(64))))
+	}
+	return operands
+}
+
+func strengthReductionDivisors() []int {
+	divisors := []int{
+		1, -1, 3, -3, 5, -5, 6, 7, -7, 10, -10, 11, 25, 100, 641, 1000,
+		1000000007, -1000000007, math.MaxInt32, math.MinInt32, math.MaxInt32 + 2,
+		1<<40 + 1, 0x5555555555555555, -0x5555555555555555,
+		math.MaxInt64, math.MinInt64 + 1,
+	}
+	for shift := 1; shift < 63; shift++ {
+		divisors = append(divisors, 1<<shift, -(1 << shift))
+	}
+	return divisors
+}
+
+// mulHigh returns the high half of the signed 128 bit product of a and b.
+func mulHigh(a int, b int) int {
+	hi, _ := bits.Mul64(uint64(a), uint64(b))
+	if a < 0 {
+		hi -= uint64(b)
+	}
+	if b < 0 {
+		hi -= uint64(a)
+	}
+	return int(hi)
+}
+
+func TestX8664DivisionMagic(t *testing.T) {
+	known := []struct {
+		divisor    int
+		multiplier uint64
+		shift      int
+	}{
+		{3, 0x5555555555555556, 0},
+		{5, 0x6666666666666667, 1},
+		{7, 0x4924924924924925, 1},
+		{10, 0x6666666666666667, 2},
+		{-5, 0x9999999999999999, 1},
+	}
+	for _, test := range known {
+		multiplier, shift := x8664DivisionMagic(test.divisor)
+		if uint64(multiplier) != test.multiplier || shift != test.shift {
+			t.Errorf("magic of %d is %#x >> %d, want %#x >> %d", test.divisor, uint64(multiplier), shift, test.multiplier, test.shift)
+		}
+	}
+
+	// the quotient computed as in Hacker's Delight 10-4
+	for _, d := range strengthReductionDivisors() {
+		if d == 1 || d == -1 || d&(d-1) == 0 {
+			continue
+		}
+		multiplier, shift := x8664DivisionMagic(d)
+		for _, n := range strengthReductionOperands() {
+			q := mulHigh(n, multiplier)
+			if d > 0 && multiplier < 0 {
+				q += n
+			} else if d < 0 && multiplier > 0 {
+				q -= n
+			}
+			q >>= uint(shift)
+			q += int(uint64(q) >> 63)
+			if q != n/d {
+				t.Errorf("%d / %d with the magic %d >> %d is %d, want %d", n, d, multiplier, shift, q, n/d)
+			}
+		}
+	}
+}
+
+// x8664Machine runs the instructions emitted by the strength reduction,
+// the registers hold 64 bit values.
+type x8664Machine struct {
+	t    *testing.T
+	regs map[string]int
+}
+
+func (m x8664Machine) value(operand string) int {
+	if value, err := strconv.ParseInt(operand, 10, 64); err == nil {
+		return int(value)
+	}
+	if _, ok := x8664ByteRegisters[operand]; !ok {
+		m.t.Fatalf("unexpected operand '%s'", operand)
+	}
+	return m.regs[operand]
+}
+
+// address returns the value of an operand like [rax+rax*4].
+func (m x8664Machine) address(operand string) int {
+	var base, index string
+	var scale int
+	if _, err := fmt.Sscanf(strings.NewReplacer("[", "", "]", "", "+", " ", "*", " ").Replace(operand),
+		"%s %s %d", &base, &index, &scale); err != nil {
+		m.t.Fatalf("unexpected address '%s'", operand)
+	}
+	return m.value(base) + m.value(index)*scale
+}
+
+func (m x8664Machine) run(code []asmLine) {
+	for _, line := range code {
+		if line.op == "" {
+			continue
+		}
+		args := line.args
+		switch {
+		case line.op == "mov" && len(args) == 2:
+			m.regs[args[0]] = m.value(args[1])
+		case line.op == "lea" && len(args) == 2:
+			m.regs[args[0]] = m.address(args[1])
+		case line.op == "add" && len(args) == 2:
+			m.regs[args[0]] += m.value(args[1])
+		case line.op == "sub" && len(args) == 2:
+			m.regs[args[0]] -= m.value(args[1])
+		case line.op == "neg" && len(args) == 1:
+			m.regs[args[0]] = -m.regs[args[0]]
+		case line.op == "shl" && len(args) == 2:
+			m.regs[args[0]] <<= uint(m.value(args[1]))
+		case line.op == "sar" && len(args) == 2:
+			m.regs[args[0]] >>= uint(m.value(args[1]))
+		case line.op == "shr" && len(args) == 2:
+			m.regs[args[0]] = int(uint64(m.regs[args[0]]) >> uint(m.value(args[1])))
+		case line.op == "imul" && len(args) == 1:
+			a := m.value(args[0])
+			m.regs["rax"], m.regs["rdx"] = m.regs["rax"]*a, mulHigh(m.regs["rax"], a)
+		case line.op == "imul" && len(args) == 2:
+			m.regs[args[0]] *= m.value(args[1])
+		case line.op == "imul" && len(args) == 3:
+			m.regs[args[0]] = m.value(args[1]) * m.value(args[2])
+		default:
+			m.t.Fatalf("unexpected instruction '%s'", line)
+		}
+	}
+}
+
+// runConstantOp emits the code of 'c op' with the operand on top of the
+// stack and another value below it, both in registers, and runs it. It
+// returns the values left on the stack above the other value, which must
+// be kept.
+func runConstantOp(t *testing.T, op Intrinsic, c int, cache []string, operand int) (results []int, ok bool) {
+	const below = 0x0123456789abcdef
+	gen := x86_64Generator{cache: append([]string{}, cache...)}
+	m := x8664Machine{t: t, regs: map[string]int{cache[0]: below, cache[1]: operand}}
+	push := Instruction{Kind: InstKindPushInt, ValueInt: c}
+	if !generateX8664ConstantOp(&gen, push, Instruction{Kind: InstKindIntrinsic, ValueIntrinsic: op}) {
+		return nil, false
+	}
+	m.run(gen.code)
+	if len(gen.cache) == 0 || m.regs[gen.cache[0]] != below {
+		t.Fatalf("%d %s: the value below the operand is lost", c, op)
+	}
+	for _, reg := range gen.cache[1:] {
+		results = append(results, m.regs[reg])
+	}
+	return results, true
+}
+
+// the operand is put both in rdx and in rax, the registers used by the
+// one operand imul
+var strengthReductionCaches = [][]string{{"rax", "rdx"}, {"rdx", "rax"}, {"rbx", "rcx"}}
+
+func TestX8664DivModConst(t *testing.T) {
+	for _, c := range []int{0, math.MinInt64} {
+		if _, ok := runConstantOp(t, IntrinsicDivMod, c, strengthReductionCaches[0], 1); ok {
+			t.Errorf("divmod by %d is reduced, it must be left to idiv", c)
+		}
+	}
+	for _, c := range strengthReductionDivisors() {
+		for _, cache := range strengthReductionCaches {
+			for _, n := range strengthReductionOperands() {
+				got, ok := runConstantOp(t, IntrinsicDivMod, c, cache, n)
+				if !ok {
+					t.Fatalf("divmod by %d is not reduced", c)
+				}
+				if len(got) != 2 || got[0] != n/c || got[1] != n%c {
+					t.Fatalf("%d %d divmod gives %v with the operand in %s, want [%d %d]", n, c, got, cache[1], n/c, n%c)
+				}
+			}
+		}
+	}
+}
+
+func TestX8664MulConst(t *testing.T) {
+	factors := []int{0, 1, -1, 2, 3, -3, 5, 9, -9, 6, 10, 12, 40, -40, 7, 1000, -1000,
+		1 << 40, 3 << 40, -(5 << 40), math.MaxInt32, math.MinInt32, math.MinInt64}
+	for _, c := range factors {
+		for _, cache := range strengthReductionCaches {
+			for _, n := range strengthReductionOperands() {
+				got, ok := runConstantOp(t, IntrinsicTimes, c, cache, n)
+				if !ok {
+					t.Fatalf("mul by %d is not reduced", c)
+				}
+				if len(got) != 1 || got[0] != n*c {
+					t.Fatalf("%d %d * gives %v with the operand in %s, want [%d]", n, c, got, cache[1], n*c)
+				}
+			}
+		}
+	}
+	if _, ok := runConstantOp(t, IntrinsicTimes, 7<<40, strengthReductionCaches[0], 1); ok {
+		t.Errorf("mul by %d doesn't fit an immediate, it must be left to imul", 7<<40)
+	}
+}
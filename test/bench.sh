@@ -0,0 +1,53 @@
+#!/bin/sh
+# bench.sh [OLD [NEW]]: compare the time of test/bench_calls.tin compiled
+# by tinc at two revisions, by default 7840c99 (the data stack on rsp)
+# and HEAD (the data stack on r15). Each binary runs $RUNS times, 5 by
+# default, and the median is printed. It needs git, go, nasm and ld, run
+# it from the root of the repository.
+set -e
+
+old=${1:-7840c99}
+new=${2:-HEAD}
+runs=${RUNS:-5}
+
+for tool in git go nasm ld; do
+    if ! command -v $tool > /dev/null; then
+        echo "bench.sh: $tool is not on the PATH" >&2
+        exit 1
+    fi
+done
+
+root=$(pwd)
+work=$(mktemp -d)
+trap 'rm -rf "$work"; git -C "$root" worktree prune' EXIT
+
+# build builds tinc at the revision $2 in $work/$1 and compiles the
+# benchmark of the current tree with it
+build() {
+    git worktree add --quiet --detach "$work/$1" "$2"
+    cp "$root/test/bench_calls.tin" "$work/$1/test/bench_calls.tin"
+    (cd "$work/$1" && go build -o tinc ./cmd/tinc && ./tinc test/bench_calls.tin)
+}
+
+# median prints the median time in seconds of $runs runs of $1
+median() {
+    for run in $(seq "$runs"); do
+        start=$(date +%s.%N)
+        "$1" > /dev/null
+        end=$(date +%s.%N)
+        echo "$start $end" | awk '{ printf "%.3f\n", $2 - $1 }'
+    done | sort -n | awk '{ t[NR] = $1 } END { print t[int((NR + 1) / 2)] }'
+}
+
+build old "$old"
+build new "$new"
+"$work/old/test/bench_calls" > "$work/old.out"
+"$work/new/test/bench_calls" > "$work/new.out"
+if ! cmp -s "$work/old.out" "$work/new.out"; then
+    echo "bench.sh: the two binaries print different results" >&2
+    exit 1
+fi
+
+echo "$old: $(median "$work/old/test/bench_calls")s"
+echo "$new: $(median "$work/new/test/bench_calls")s"
+echo "median of $runs runs on $(uname -m), $(nasm -v)"
@@ -0,0 +1,155 @@
+_start:
+  mov rsp, ret_stack+1280
+  mov r15, data_stack+8388608
+  ;; the output is flushed at every newline when stdout is a tty
+  mov rax, 16
+  mov rdi, 1
+  mov rsi, 0x5401
+  mov rdx, out_buf
+  syscall
+  test rax, rax
+  jnz .stdout_checked
+  mov QWORD [out_tty], 1
+.stdout_checked:
+  ;; push int
+  mov rax, 1
+  ;; push int
+  mov rbx, 2
+  ;; add
+  add rax, rbx
+  ;; push int
+  mov rbx, 3
+  ;; mul
+  imul rax, rbx
+  ;; push int
+  mov rbx, 4
+  ;; sub
+  sub rax, rbx
+  ;; print
+  mov rdi, rax
+  mov rsi, 522
+  call print_number
+  ;; push int
+  mov rax, 10
+  ;; mem push
+  mov rbx, mem+0
+  ;; store 64
+  mov [rbx], rax
+  ;; mem push
+  mov rax, mem+0
+  ;; load 64
+  mov rax, [rax]
+  ;; dup
+  mov rbx, rax
+  ;; push int
+  mov rcx, 5
+  ;; greather
+  cmp rbx, rcx
+  setg bl
+  movzx rbx, bl
+  ;; test condition
+  lea r15, [r15-8]
+  mov [r15], rax
+  test rbx, rbx
+  jz addr_23
+  ;; mem push
+  mov rax, mem+0
+  ;; load 64
+  mov rax, [rax]
+  ;; push int
+  mov rbx, 1
+  ;; add
+  add rax, rbx
+  ;; print
+  mov rdi, rax
+  mov rsi, 522
+  call print_number
+  ;; end
+  jmp addr_23
+addr_23:
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; fun skip
+  jmp addr_29
+fn_add_one:
+  ;; fun def
+  cmp rsp, ret_stack+256
+  jae .ret_ok_1
+  mov rsi, str_0
+  mov rdx, 72
+  jmp return_stack_overflow
+.ret_ok_1:
+  ;; push int
+  mov rax, 1
+  ;; add
+  mov rbx, [r15]
+  add r15, 8
+  add rbx, rax
+  ;; fun ret
+  lea r15, [r15-8]
+  mov [r15], rbx
+  ret
+addr_29:
+  ;; push int
+  mov rax, 0
+  ;; push int
+  mov rbx, 0
+  ;; push int
+  mov rcx, 1000
+  ;; for start
+  lea r15, [r15-8]
+  mov [r15], rax
+  cmp rsp, ret_stack+272
+  jae .ret_ok_2
+  mov rsi, str_1
+  mov rdx, 51
+  jmp return_stack_overflow
+.ret_ok_2:
+  push r12
+  push r13
+  mov r13, rcx
+  mov r12, rbx
+addr_33:
+  ;; for test
+  cmp r12, r13
+  jge addr_36
+  ;; fun call
+  call fn_add_one
+  ;; for next
+  add r12, 1
+  jmp addr_33
+addr_36:
+  ;; for end
+  pop r13
+  pop r12
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  call flush_output
+  ;; exit syscall
+  mov rax, 0x3c
+  mov rdi, 0
+  syscall
+
+section .data
+str_0: db `test/golden/cache.tin:14:1: return stack overflow in function 'add_one'\n`
+str_1: db `test/golden/cache.tin:15:10: return stack overflow\n`
+
+section .rodata
+print_digits: db `0123456789abcdef`
+
+section .bss
+	ret_stack: resb 1280
+	data_stack: resb 8388608
+	out_len: resq 1
+	out_tty: resq 1
+	out_buf: resb 4096
+	free_list: resq 1
+	heap_top: resq 1
+	heap_end: resq 1
+	mem: resb 8
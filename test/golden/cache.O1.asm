@@ -0,0 +1,122 @@
+_start:
+  mov rsp, ret_stack+1280
+  mov r15, data_stack+8388608
+  ;; the output is flushed at every newline when stdout is a tty
+  mov rax, 16
+  mov rdi, 1
+  mov rsi, 0x5401
+  mov rdx, out_buf
+  syscall
+  test rax, rax
+  jnz .stdout_checked
+  mov QWORD [out_tty], 1
+.stdout_checked:
+  ;; push int
+  mov rax, 5
+  ;; print
+  mov rdi, rax
+  mov rsi, 522
+  call print_number
+  ;; push int
+  mov rax, 10
+  ;; mem push
+  mov rbx, mem+0
+  ;; store 64
+  mov [rbx], rax
+  ;; mem push
+  mov rax, mem+0
+  ;; load 64
+  mov rax, [rax]
+  ;; dup
+  mov rbx, rax
+  ;; push int
+  mov rcx, 5
+  ;; greather
+  cmp rbx, rcx
+  lea r15, [r15-8]
+  mov [r15], rax
+  jle addr_16
+  ;; test condition
+  ;; mem push
+  mov rax, mem+0
+  ;; load 64
+  mov rax, [rax]
+  ;; push int
+  mov rbx, 1
+  ;; add
+  add rax, rbx
+  ;; print
+  mov rdi, rax
+  mov rsi, 522
+  call print_number
+addr_16:
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; push int
+  xor eax, eax
+  ;; push int
+  xor ebx, ebx
+  ;; push int
+  mov rcx, 1000
+  ;; for start
+  lea r15, [r15-8]
+  mov [r15], rax
+  cmp rsp, ret_stack+272
+  jae .ret_ok_1
+  mov rsi, str_0
+  mov rdx, 51
+  jmp return_stack_overflow
+.ret_ok_1:
+  push r12
+  push r13
+  mov r13, rcx
+  mov r12, rbx
+addr_21:
+  ;; for test
+  cmp r12, r13
+  jge addr_25
+  ;; push int
+  mov rax, 1
+  ;; add
+  mov rbx, [r15]
+  add r15, 8
+  add rbx, rax
+  ;; for next
+  lea r15, [r15-8]
+  mov [r15], rbx
+  add r12, 1
+  jmp addr_21
+addr_25:
+  ;; for end
+  pop r13
+  pop r12
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  call flush_output
+  ;; exit syscall
+  mov rax, 0x3c
+  xor edi, edi
+  syscall
+
+section .data
+str_0: db `test/golden/cache.tin:15:10: return stack overflow\n`
+
+section .rodata
+print_digits: db `0123456789abcdef`
+
+section .bss
+	ret_stack: resb 1280
+	data_stack: resb 8388608
+	out_len: resq 1
+	out_tty: resq 1
+	out_buf: resb 4096
+	free_list: resq 1
+	heap_top: resq 1
+	heap_end: resq 1
+	mem: resb 8
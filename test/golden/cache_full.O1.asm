@@ -0,0 +1,223 @@
+_start:
+  mov rsp, ret_stack+1280
+  mov r15, data_stack+8388608
+  ;; the output is flushed at every newline when stdout is a tty
+  mov rax, 16
+  mov rdi, 1
+  mov rsi, 0x5401
+  mov rdx, out_buf
+  syscall
+  test rax, rax
+  jnz .stdout_checked
+  mov QWORD [out_tty], 1
+.stdout_checked:
+  ;; push int
+  mov rax, 1
+  ;; push int
+  mov rbx, 2
+  ;; push int
+  mov rcx, 3
+  ;; push int
+  mov rdx, 4
+  ;; push int
+  mov rsi, 5
+  ;; push int
+  mov rdi, 6
+  ;; push int
+  mov r8, 7
+  ;; push int
+  mov r9, 8
+  ;; push int
+  mov r10, 9
+  ;; push int
+  xor r11d, r11d
+  ;; push int
+  sub r15, 8
+  mov [r15], rax
+  mov rax, 10
+  ;; print
+  sub r15, 8
+  mov [r15], rbx
+  mov rbx, rdi
+  mov rdi, rax
+  lea r15, [r15-64]
+  mov [r15+56], rcx
+  mov [r15+48], rdx
+  mov [r15+40], rsi
+  mov [r15+32], rbx
+  mov [r15+24], r8
+  mov [r15+16], r9
+  mov [r15+8], r10
+  mov [r15], r11
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; push int
+  mov rax, 1
+  ;; push int
+  mov rbx, 2
+  ;; push int
+  mov rcx, 3
+  ;; push int
+  mov rdx, 4
+  ;; push int
+  mov rsi, 5
+  ;; push int
+  mov rdi, 6
+  ;; push int
+  mov r8, 7
+  ;; push int
+  mov r9, 8
+  ;; push int
+  mov r10, 9
+  ;; push int
+  mov r11, 10
+  ;; flush
+  lea r15, [r15-80]
+  mov [r15+72], rax
+  mov [r15+64], rbx
+  mov [r15+56], rcx
+  mov [r15+48], rdx
+  mov [r15+40], rsi
+  mov [r15+32], rdi
+  mov [r15+24], r8
+  mov [r15+16], r9
+  mov [r15+8], r10
+  mov [r15], r11
+  call flush_output
+  ;; push string
+  mov rax, 8
+  mov rbx, str_0
+  ;; push int
+  mov rcx, 1
+  ;; push int
+  mov rdx, 1
+  ;; syscall3
+  mov rsi, rax
+  mov rax, rdx
+  mov rdi, rcx
+  mov rcx, rsi
+  mov rsi, rbx
+  mov rdx, rcx
+  call flush_on_exit
+  syscall
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  call flush_output
+  ;; exit syscall
+  mov rax, 0x3c
+  xor edi, edi
+  syscall
+
+section .data
+str_0: db `syscall\n`
+
+section .rodata
+print_digits: db `0123456789abcdef`
+
+section .bss
+	ret_stack: resb 1280
+	data_stack: resb 8388608
+	out_len: resq 1
+	out_tty: resq 1
+	out_buf: resb 4096
+	free_list: resq 1
+	heap_top: resq 1
+	heap_end: resq 1
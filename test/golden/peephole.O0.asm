@@ -0,0 +1,150 @@
+_start:
+  mov rsp, ret_stack+1280
+  mov r15, data_stack+8388608
+  ;; the output is flushed at every newline when stdout is a tty
+  mov rax, 16
+  mov rdi, 1
+  mov rsi, 0x5401
+  mov rdx, out_buf
+  syscall
+  test rax, rax
+  jnz .stdout_checked
+  mov QWORD [out_tty], 1
+.stdout_checked:
+  ;; push int
+  mov rax, 7
+  ;; mem push
+  mov rbx, mem+0
+  ;; store 64
+  mov [rbx], rax
+  ;; push int
+  mov rax, 1
+  ;; push int
+  mov rbx, 2
+  ;; push int
+  mov rcx, 3
+  ;; mem push
+  mov rdx, mem+0
+  ;; load 64
+  mov rdx, [rdx]
+  ;; push int
+  mov rsi, 5
+  ;; greather
+  cmp rdx, rsi
+  setg dl
+  movzx rdx, dl
+  ;; test condition
+  lea r15, [r15-24]
+  mov [r15+16], rax
+  mov [r15+8], rbx
+  mov [r15], rcx
+  test rdx, rdx
+  jz addr_14
+  ;; push int
+  mov rax, 1
+  ;; print
+  mov rdi, rax
+  mov rsi, 522
+  call print_number
+  ;; end
+  jmp addr_14
+addr_14:
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; push int
+  mov rax, 10
+  ;; push int
+  mov rbx, 20
+  ;; mem push
+  mov rcx, mem+0
+  ;; load 64
+  mov rcx, [rcx]
+  ;; push int
+  mov rdx, 0
+  ;; greather
+  cmp rcx, rdx
+  setg cl
+  movzx rcx, cl
+  ;; test condition
+  lea r15, [r15-16]
+  mov [r15+8], rax
+  mov [r15], rbx
+  test rcx, rcx
+  jz addr_26
+  ;; add
+  mov rax, [r15]
+  add r15, 8
+  mov rbx, [r15]
+  add r15, 8
+  add rbx, rax
+  ;; else
+  lea r15, [r15-8]
+  mov [r15], rbx
+  jmp addr_28
+addr_26:
+  ;; sub
+  mov rax, [r15]
+  add r15, 8
+  mov rbx, [r15]
+  add r15, 8
+  sub rbx, rax
+  ;; end
+  lea r15, [r15-8]
+  mov [r15], rbx
+  jmp addr_28
+addr_28:
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; push int
+  mov rax, 0
+  ;; print
+  mov rdi, rax
+  mov rsi, 522
+  call print_number
+  ;; push int
+  mov rax, 0
+  ;; push int
+  mov rbx, 0
+  ;; add
+  add rax, rbx
+  ;; print
+  mov rdi, rax
+  mov rsi, 522
+  call print_number
+  call flush_output
+  ;; exit syscall
+  mov rax, 0x3c
+  mov rdi, 0
+  syscall
+
+section .data
+
+section .rodata
+print_digits: db `0123456789abcdef`
+
+section .bss
+	ret_stack: resb 1280
+	data_stack: resb 8388608
+	out_len: resq 1
+	out_tty: resq 1
+	out_buf: resb 4096
+	free_list: resq 1
+	heap_top: resq 1
+	heap_end: resq 1
+	mem: resb 8
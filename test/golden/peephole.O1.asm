@@ -0,0 +1,134 @@
+_start:
+  mov rsp, ret_stack+1280
+  mov r15, data_stack+8388608
+  ;; the output is flushed at every newline when stdout is a tty
+  mov rax, 16
+  mov rdi, 1
+  mov rsi, 0x5401
+  mov rdx, out_buf
+  syscall
+  test rax, rax
+  jnz .stdout_checked
+  mov QWORD [out_tty], 1
+.stdout_checked:
+  ;; push int
+  mov rax, 7
+  ;; mem push
+  mov rbx, mem+0
+  ;; store 64
+  mov [rbx], rax
+  ;; push int
+  mov rax, 1
+  ;; push int
+  mov rbx, 2
+  ;; push int
+  mov rcx, 3
+  ;; mem push
+  mov rdx, mem+0
+  ;; load 64
+  mov rdx, [rdx]
+  ;; push int
+  mov rsi, 5
+  ;; greather
+  cmp rdx, rsi
+  lea r15, [r15-24]
+  mov [r15+16], rax
+  mov [r15+8], rbx
+  mov [r15], rcx
+  jle addr_13
+  ;; test condition
+  ;; push int
+  mov rax, 1
+  ;; print
+  mov rdi, rax
+  mov rsi, 522
+  call print_number
+addr_13:
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; push int
+  mov rax, 10
+  ;; push int
+  mov rbx, 20
+  ;; mem push
+  mov rcx, mem+0
+  ;; load 64
+  mov rcx, [rcx]
+  ;; push int
+  xor edx, edx
+  ;; greather
+  cmp rcx, rdx
+  lea r15, [r15-16]
+  mov [r15+8], rax
+  mov [r15], rbx
+  jle addr_25
+  ;; test condition
+  ;; add
+  mov rax, [r15]
+  mov rbx, [r15+8]
+  lea r15, [r15+16]
+  add rbx, rax
+  ;; else
+  lea r15, [r15-8]
+  mov [r15], rbx
+  jmp addr_26
+addr_25:
+  ;; sub
+  mov rax, [r15]
+  mov rbx, [r15+8]
+  lea r15, [r15+16]
+  sub rbx, rax
+  lea r15, [r15-8]
+  mov [r15], rbx
+addr_26:
+  ;; print
+  mov rdi, [r15]
+  add r15, 8
+  mov rsi, 522
+  call print_number
+  ;; push int
+  xor eax, eax
+  ;; print
+  mov rdi, rax
+  mov rsi, 522
+  call print_number
+  ;; push int
+  xor eax, eax
+  ;; print
+  mov rdi, rax
+  mov rsi, 522
+  call print_number
+  call flush_output
+  ;; exit syscall
+  mov rax, 0x3c
+  xor edi, edi
+  syscall
+
+section .data
+
+section .rodata
+print_digits: db `0123456789abcdef`
+
+section .bss
+	ret_stack: resb 1280
+	data_stack: resb 8388608
+	out_len: resq 1
+	out_tty: resq 1
+	out_buf: resb 4096
+	free_list: resq 1
+	heap_top: resq 1
+	heap_end: resq 1
+	mem: resb 8